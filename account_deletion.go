@@ -0,0 +1,294 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+)
+
+const (
+	chirpPolicyDelete    = "delete"
+	chirpPolicyAnonymize = "anonymize"
+)
+
+var errNothingToPurge = errors.New("no accounts due for deletion")
+
+type deletionPolicy struct {
+	GracePeriod time.Duration
+	// what happens to a deleted user's chirps: removed outright, or kept
+	// with the author detached
+	ChirpPolicy   string
+	SweepInterval time.Duration
+}
+
+func deletionPolicyFromEnv() (deletionPolicy, error) {
+	policy := deletionPolicy{
+		GracePeriod:   time.Duration(envInt("ACCOUNT_DELETION_GRACE_HOURS", 30*24)) * time.Hour,
+		ChirpPolicy:   envString("ACCOUNT_DELETION_CHIRP_POLICY", chirpPolicyDelete),
+		SweepInterval: time.Duration(envInt("ACCOUNT_DELETION_SWEEP_SECONDS", 60)) * time.Second,
+	}
+	if policy.ChirpPolicy != chirpPolicyDelete && policy.ChirpPolicy != chirpPolicyAnonymize {
+		return deletionPolicy{}, errors.New("ACCOUNT_DELETION_CHIRP_POLICY must be delete or anonymize")
+	}
+	if policy.SweepInterval <= 0 {
+		return deletionPolicy{}, errors.New("ACCOUNT_DELETION_SWEEP_SECONDS must be positive")
+	}
+	return policy, nil
+}
+
+func scheduleAccountDeletion(db *DB, userID int, deleteAt time.Time) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		user, found := dbStructure.Users[userID]
+		if !found {
+			return errors.New("user not found")
+		}
+		user.DeletionScheduledAt = &deleteAt
+		dbStructure.Users[userID] = user
+		appendAuditEntry(dbStructure, userID, "user.deletion_scheduled", userID, deleteAt.Format(time.RFC3339))
+		return nil
+	})
+}
+
+func cancelAccountDeletion(db *DB, userID int) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		user, found := dbStructure.Users[userID]
+		if !found {
+			return errors.New("user not found")
+		}
+		if user.DeletionScheduledAt == nil {
+			return errors.New("account is not scheduled for deletion")
+		}
+		user.DeletionScheduledAt = nil
+		dbStructure.Users[userID] = user
+		appendAuditEntry(dbStructure, userID, "user.deletion_cancelled", userID, "")
+		return nil
+	})
+}
+
+/*
+purgeDueAccounts removes every account whose grace period has ended. All of a
+user's data is removed in the same write as the user record, so a crash or
+error part way through leaves the account either fully intact (and picked up
+by the next sweep) or fully gone. Direct messages are the exception; see
+purgeDeletedMessages.
+*/
+func purgeDueAccounts(db *DB, chirpPolicy string, now time.Time) ([]int, []int, error) {
+	purgedUsers := []int{}
+	removedChirps := []int{}
+	// export files are removed once the write has gone through, so a failed
+	// write can't leave jobs pointing at missing files
+	exportFiles := []string{}
+
+	err := db.update(func(dbStructure *DBStructure) error {
+		for userID, user := range dbStructure.Users {
+			if user.DeletionScheduledAt == nil || now.Before(*user.DeletionScheduledAt) {
+				continue
+			}
+
+			for chirpID, chirp := range dbStructure.Chirps {
+				if chirp.AuthorID != userID {
+					continue
+				}
+				// rechirps carry nothing worth keeping anonymously
+				if chirpPolicy == chirpPolicyAnonymize && chirp.RechirpOf == 0 {
+					chirp.AuthorID = 0
+					dbStructure.Chirps[chirpID] = chirp
+					continue
+				}
+				dbStructure.removeChirp(chirpID)
+				removedChirps = append(removedChirps, chirpID)
+			}
+			dbStructure.removeUserReactions(userID)
+			dbStructure.removeUserFollows(userID)
+			dbStructure.removeUserRestrictions(userID)
+			dbStructure.removeUserMedia(userID)
+			dbStructure.removeUserBookmarks(userID)
+			delete(dbStructure.Notifications, userID)
+			dbStructure.removeNotifications(func(recipientID int, notification Notification) bool {
+				return notification.ActorID == userID
+			})
+
+			for tokenID, accessToken := range dbStructure.AccessTokens {
+				if accessToken.UserID == userID {
+					delete(dbStructure.AccessTokens, tokenID)
+				}
+			}
+			for codeHash, authCode := range dbStructure.AuthorizationCodes {
+				if authCode.UserID == userID {
+					delete(dbStructure.AuthorizationCodes, codeHash)
+				}
+			}
+			for clientID, client := range dbStructure.OAuthClients {
+				if client.OwnerID == userID {
+					delete(dbStructure.OAuthClients, clientID)
+				}
+			}
+			for jobID, job := range dbStructure.ExportJobs {
+				if job.UserID == userID {
+					if job.FilePath != "" {
+						exportFiles = append(exportFiles, job.FilePath)
+					}
+					delete(dbStructure.ExportJobs, jobID)
+				}
+			}
+
+			// sessions live on the user record and go with it
+			delete(dbStructure.Users, userID)
+			appendAuditEntry(dbStructure, userID, "user.deleted", userID, chirpPolicy)
+			purgedUsers = append(purgedUsers, userID)
+			dbStructure.PendingMessagePurges = append(dbStructure.PendingMessagePurges, userID)
+		}
+
+		if len(purgedUsers) == 0 {
+			return errNothingToPurge
+		}
+		return nil
+	})
+	if errors.Is(err, errNothingToPurge) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, path := range exportFiles {
+		os.Remove(path)
+	}
+
+	return purgedUsers, removedChirps, nil
+}
+
+/*
+purgeDeletedMessages removes the direct messages of purged accounts. They live
+in their own store, so they can't go in the same write as the accounts; the
+ids wait in PendingMessagePurges until the message store has been updated, and
+a failure is retried by the next sweep.
+*/
+func purgeDeletedMessages(db *DB, messages *MessageDB) error {
+	dbStructure, err := db.LoadDB()
+	if err != nil {
+		return err
+	}
+	pending := dbStructure.PendingMessagePurges
+	if len(pending) == 0 {
+		return nil
+	}
+
+	err = messages.removeUsers(pending)
+	if err != nil {
+		return err
+	}
+	return db.update(func(dbStructure *DBStructure) error {
+		dbStructure.PendingMessagePurges = slices.DeleteFunc(dbStructure.PendingMessagePurges, func(userID int) bool {
+			return slices.Contains(pending, userID)
+		})
+		return nil
+	})
+}
+
+func (config *apiConfig) runDeletionSweeper() {
+	ticker := time.NewTicker(config.deletionPolicy.SweepInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		purged, _, err := purgeDueAccounts(config.db, config.deletionPolicy.ChirpPolicy, time.Now().UTC())
+		if err != nil {
+			log.Printf("account deletion sweep failed: %v", err)
+			continue
+		}
+		if len(purged) > 0 {
+			log.Printf("deleted %d accounts", len(purged))
+			config.rebuildSearchIndex()
+			config.timelines.Clear()
+		}
+		// also retries messages a previous sweep failed to remove
+		err = purgeDeletedMessages(config.db, config.messages)
+		if err != nil {
+			log.Printf("removing messages of deleted accounts failed: %v", err)
+		}
+	}
+}
+
+/*
+route: /api/users
+method: DELETE
+
+	req body shape: {
+		password string
+	}
+
+	req headers: {
+		Authorization string (jwtToken)
+	}
+
+Schedules the account for deletion once the grace period ends.
+*/
+func (config *apiConfig) deleteUserHandler(w http.ResponseWriter, req *http.Request) {
+	id, err := config.authenticateSession(req)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	params, err := decodeJSON(req)
+	if err != nil {
+		respondWithError(w, 500, "error decoding request body")
+		return
+	}
+
+	user, err := findUserById(config.db, id)
+	if err != nil {
+		respondWithError(w, 401, err.Error())
+		return
+	}
+
+	// a stolen session token alone must not be enough to delete an account
+	match, err := config.db.hasher.Verify(user.Password, params.Password)
+	if err != nil || !match {
+		respondWithError(w, 401, "incorrect password")
+		return
+	}
+
+	deleteAt := time.Now().UTC().Add(config.deletionPolicy.GracePeriod)
+	err = scheduleAccountDeletion(config.db, id, deleteAt)
+	if err != nil {
+		respondWithError(w, 500, err.Error())
+		return
+	}
+
+	respondWithJSON(w, 202, struct {
+		DeletionScheduledAt time.Time `json:"deletion_scheduled_at"`
+	}{
+		DeletionScheduledAt: deleteAt,
+	})
+}
+
+/*
+route: /api/users/deletion/cancel
+method: POST
+
+	req headers: {
+		Authorization string (jwtToken)
+	}
+*/
+func (config *apiConfig) cancelUserDeletionHandler(w http.ResponseWriter, req *http.Request) {
+	id, err := config.authenticateSession(req)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	err = cancelAccountDeletion(config.db, id)
+	if err != nil {
+		if err.Error() == "account is not scheduled for deletion" {
+			respondWithError(w, 409, err.Error())
+			return
+		}
+		respondWithError(w, 500, err.Error())
+		return
+	}
+
+	w.WriteHeader(204)
+}
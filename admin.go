@@ -0,0 +1,512 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type AuditEntry struct {
+	ID           int       `json:"id"`
+	ActorID      int       `json:"actor_id"`
+	Action       string    `json:"action"`
+	TargetUserID int       `json:"target_user_id,omitempty"`
+	Details      string    `json:"details,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+const (
+	passwordResetLifetime = 24 * time.Hour
+	defaultAdminPageSize  = 50
+	maxAdminPageSize      = 200
+)
+
+var (
+	errAccountSuspended      = errors.New("account is suspended")
+	errPasswordResetRequired = errors.New("password reset required")
+)
+
+// appendAuditEntry must be called inside the same db.update as the action it
+// records so the two are written together.
+func appendAuditEntry(dbStructure *DBStructure, actorID int, action string, targetUserID int, details string) {
+	dbStructure.AuditLog = append(dbStructure.AuditLog, AuditEntry{
+		ID:           len(dbStructure.AuditLog) + 1,
+		ActorID:      actorID,
+		Action:       action,
+		TargetUserID: targetUserID,
+		Details:      details,
+		CreatedAt:    time.Now().UTC(),
+	})
+}
+
+// revokeSessions signs the user out everywhere: their login refresh token
+// and every OAuth grant stop working.
+func revokeSessions(user *User) {
+	user.RefreshToken = RefreshToken{}
+	user.ClientRefreshTokens = nil
+}
+
+// updateUserAsAdmin applies fn to a user and records the action in the audit
+// log in a single write.
+func updateUserAsAdmin(db *DB, actorID, userID int, action, details string, fn func(user *User) error) (User, error) {
+	user := User{}
+	err := db.update(func(dbStructure *DBStructure) error {
+		found := false
+		user, found = dbStructure.Users[userID]
+		if !found {
+			return errors.New("user not found")
+		}
+
+		err := fn(&user)
+		if err != nil {
+			return err
+		}
+
+		dbStructure.Users[userID] = user
+		appendAuditEntry(dbStructure, actorID, action, userID, details)
+		return nil
+	})
+	if err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+// issuePasswordReset forces a password reset, signing the user out and
+// revoking their access tokens in the same write as the audit entry.
+func issuePasswordReset(db *DB, actorID, userID int) (string, error) {
+	token := generateRefreshToken()
+	err := db.update(func(dbStructure *DBStructure) error {
+		user, found := dbStructure.Users[userID]
+		if !found {
+			return errors.New("user not found")
+		}
+
+		expiresAt := time.Now().UTC().Add(passwordResetLifetime)
+		user.PasswordResetRequired = true
+		user.PasswordResetTokenHash = hashToken(token)
+		user.PasswordResetExpiresAt = &expiresAt
+		revokeSessions(&user)
+		dbStructure.Users[userID] = user
+
+		for id, accessToken := range dbStructure.AccessTokens {
+			if accessToken.UserID == userID {
+				delete(dbStructure.AccessTokens, id)
+			}
+		}
+		appendAuditEntry(dbStructure, actorID, "user.password_reset", userID, "")
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+func completePasswordReset(db *DB, token, password string) error {
+	hashedPassword, err := db.hasher.Hash(password)
+	if err != nil {
+		return err
+	}
+
+	return db.update(func(dbStructure *DBStructure) error {
+		tokenHash := hashToken(token)
+		for id, user := range dbStructure.Users {
+			if !user.PasswordResetRequired || user.PasswordResetTokenHash != tokenHash {
+				continue
+			}
+			if user.PasswordResetExpiresAt == nil || time.Now().UTC().After(*user.PasswordResetExpiresAt) {
+				break
+			}
+
+			user.Password = hashedPassword
+			user.PasswordResetRequired = false
+			user.PasswordResetTokenHash = ""
+			user.PasswordResetExpiresAt = nil
+			dbStructure.Users[id] = user
+			return nil
+		}
+		return errors.New("reset token is invalid or expired")
+	})
+}
+
+type adminUserResponse struct {
+	ID                    int        `json:"id"`
+	Email                 string     `json:"email"`
+	Role                  string     `json:"role"`
+	IsChirpyRed           bool       `json:"is_chirpy_red"`
+	Suspended             bool       `json:"suspended"`
+	SuspendedAt           *time.Time `json:"suspended_at,omitempty"`
+	SuspensionReason      string     `json:"suspension_reason,omitempty"`
+	PasswordResetRequired bool       `json:"password_reset_required"`
+}
+
+type sessionResponse struct {
+	Type      string    `json:"type"`
+	ClientID  string    `json:"client_id,omitempty"`
+	Scopes    []string  `json:"scopes,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func newAdminUserResponse(user User) adminUserResponse {
+	return adminUserResponse{
+		ID:                    user.ID,
+		Email:                 user.Email,
+		Role:                  userRole(user),
+		IsChirpyRed:           user.IsChirpyRed,
+		Suspended:             user.SuspendedAt != nil,
+		SuspendedAt:           user.SuspendedAt,
+		SuspensionReason:      user.SuspensionReason,
+		PasswordResetRequired: user.PasswordResetRequired,
+	}
+}
+
+func userSessions(user User) []sessionResponse {
+	sessions := []sessionResponse{}
+	if user.RefreshToken.Token != "" {
+		sessions = append(sessions, sessionResponse{
+			Type:      "login",
+			CreatedAt: user.RefreshToken.CreatedAt,
+			ExpiresAt: user.RefreshToken.CreatedAt.AddDate(0, 0, user.RefreshToken.DaysActive),
+		})
+	}
+	for _, grant := range user.ClientRefreshTokens {
+		sessions = append(sessions, sessionResponse{
+			Type:      "oauth",
+			ClientID:  grant.ClientID,
+			Scopes:    grant.Scopes,
+			CreatedAt: grant.CreatedAt,
+			ExpiresAt: grant.CreatedAt.AddDate(0, 0, grant.DaysActive),
+		})
+	}
+	return sessions
+}
+
+// pageParams reads limit and offset query parameters for admin listings.
+func pageParams(req *http.Request) (int, int) {
+	limit, err := strconv.Atoi(req.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = defaultAdminPageSize
+	}
+	if limit > maxAdminPageSize {
+		limit = maxAdminPageSize
+	}
+
+	offset, err := strconv.Atoi(req.URL.Query().Get("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+
+	return limit, offset
+}
+
+func pathUserID(w http.ResponseWriter, req *http.Request) (int, bool) {
+	userID, err := strconv.Atoi(req.PathValue("userID"))
+	if err != nil {
+		respondWithError(w, 400, "invalid user id")
+		return 0, false
+	}
+	return userID, true
+}
+
+func respondWithAdminUpdate(w http.ResponseWriter, user User, err error) {
+	if err != nil {
+		if err.Error() == "user not found" {
+			respondWithError(w, 404, err.Error())
+			return
+		}
+		respondWithError(w, 400, err.Error())
+		return
+	}
+
+	respondWithJSON(w, 200, newAdminUserResponse(user))
+}
+
+/*
+route: /admin/api/users?email={optional substring}&limit={optional}&offset={optional}
+method: GET
+
+	req headers: {
+		Authorization string (jwtToken, admin)
+	}
+*/
+func (config *apiConfig) adminListUsersHandler(w http.ResponseWriter, req *http.Request) {
+	limit, offset := pageParams(req)
+	email := strings.ToLower(req.URL.Query().Get("email"))
+
+	dbStructure, err := config.db.LoadDB()
+	if err != nil {
+		respondWithError(w, 500, err.Error())
+		return
+	}
+
+	users := []adminUserResponse{}
+	for _, user := range dbStructure.Users {
+		if email != "" && !strings.Contains(strings.ToLower(user.Email), email) {
+			continue
+		}
+		users = append(users, newAdminUserResponse(user))
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+
+	total := len(users)
+	users = users[min(offset, total):min(offset+limit, total)]
+
+	respondWithJSON(w, 200, struct {
+		Users  []adminUserResponse `json:"users"`
+		Total  int                 `json:"total"`
+		Limit  int                 `json:"limit"`
+		Offset int                 `json:"offset"`
+	}{
+		Users:  users,
+		Total:  total,
+		Limit:  limit,
+		Offset: offset,
+	})
+}
+
+/*
+route: /admin/api/users/{userID}
+method: GET
+
+	req headers: {
+		Authorization string (jwtToken, admin)
+	}
+*/
+func (config *apiConfig) adminGetUserHandler(w http.ResponseWriter, req *http.Request) {
+	userID, ok := pathUserID(w, req)
+	if !ok {
+		return
+	}
+
+	dbStructure, err := config.db.LoadDB()
+	if err != nil {
+		respondWithError(w, 500, err.Error())
+		return
+	}
+
+	user, found := dbStructure.Users[userID]
+	if !found {
+		respondWithError(w, 404, "user not found")
+		return
+	}
+
+	chirpCount := 0
+	for _, chirp := range dbStructure.Chirps {
+		if chirp.AuthorID == userID {
+			chirpCount++
+		}
+	}
+
+	accessTokenCount := 0
+	for _, accessToken := range dbStructure.AccessTokens {
+		if accessToken.UserID == userID {
+			accessTokenCount++
+		}
+	}
+
+	respondWithJSON(w, 200, struct {
+		adminUserResponse
+		ChirpCount       int               `json:"chirp_count"`
+		AccessTokenCount int               `json:"access_token_count"`
+		Sessions         []sessionResponse `json:"sessions"`
+	}{
+		adminUserResponse: newAdminUserResponse(user),
+		ChirpCount:        chirpCount,
+		AccessTokenCount:  accessTokenCount,
+		Sessions:          userSessions(user),
+	})
+}
+
+/*
+route: /admin/api/users/{userID}/suspension
+method: PUT (suspend) | DELETE (reinstate)
+
+	req body shape (PUT): {
+		reason string (optional)
+	}
+
+	req headers: {
+		Authorization string (jwtToken, admin)
+	}
+*/
+func (config *apiConfig) adminSuspendUserHandler(w http.ResponseWriter, req *http.Request) {
+	userID, ok := pathUserID(w, req)
+	if !ok {
+		return
+	}
+	actorID := userIDFromContext(req)
+
+	if req.Method == http.MethodDelete {
+		user, err := updateUserAsAdmin(config.db, actorID, userID, "user.reinstate", "", func(user *User) error {
+			user.SuspendedAt = nil
+			user.SuspensionReason = ""
+			return nil
+		})
+		respondWithAdminUpdate(w, user, err)
+		return
+	}
+
+	params, err := decodeJSON(req)
+	if err != nil {
+		respondWithError(w, 500, "error decoding request body")
+		return
+	}
+
+	if userID == actorID {
+		respondWithError(w, 400, "admins cannot suspend themselves")
+		return
+	}
+
+	user, err := updateUserAsAdmin(config.db, actorID, userID, "user.suspend", params.Reason, func(user *User) error {
+		now := time.Now().UTC()
+		user.SuspendedAt = &now
+		user.SuspensionReason = params.Reason
+		revokeSessions(user)
+		return nil
+	})
+	respondWithAdminUpdate(w, user, err)
+}
+
+/*
+route: /admin/api/users/{userID}/password-reset
+method: POST
+
+	req headers: {
+		Authorization string (jwtToken, admin)
+	}
+
+Locks the account until the user sets a new password with the returned
+single-use token, which the admin passes on out of band.
+*/
+func (config *apiConfig) adminForcePasswordResetHandler(w http.ResponseWriter, req *http.Request) {
+	userID, ok := pathUserID(w, req)
+	if !ok {
+		return
+	}
+
+	token, err := issuePasswordReset(config.db, userIDFromContext(req), userID)
+	if err != nil {
+		if err.Error() == "user not found" {
+			respondWithError(w, 404, err.Error())
+			return
+		}
+		respondWithError(w, 500, err.Error())
+		return
+	}
+
+	respondWithJSON(w, 200, struct {
+		ResetToken string    `json:"reset_token"`
+		ExpiresAt  time.Time `json:"expires_at"`
+	}{
+		ResetToken: token,
+		ExpiresAt:  time.Now().UTC().Add(passwordResetLifetime),
+	})
+}
+
+/*
+route: /admin/api/users/{userID}/chirpy-red
+method: PUT
+
+	req body shape: {
+		is_chirpy_red bool
+	}
+
+	req headers: {
+		Authorization string (jwtToken, admin)
+	}
+*/
+func (config *apiConfig) adminSetChirpyRedHandler(w http.ResponseWriter, req *http.Request) {
+	userID, ok := pathUserID(w, req)
+	if !ok {
+		return
+	}
+
+	params, err := decodeJSON(req)
+	if err != nil {
+		respondWithError(w, 500, "error decoding request body")
+		return
+	}
+
+	user, err := updateUserAsAdmin(config.db, userIDFromContext(req), userID, "user.chirpy_red", strconv.FormatBool(params.IsChirpyRed), func(user *User) error {
+		user.IsChirpyRed = params.IsChirpyRed
+		recordSubscriptionEvent(user, "admin")
+		return nil
+	})
+	respondWithAdminUpdate(w, user, err)
+}
+
+/*
+route: /admin/api/audit?limit={optional}&offset={optional}
+method: GET
+
+	req headers: {
+		Authorization string (jwtToken, admin)
+	}
+
+Newest entries first.
+*/
+func (config *apiConfig) adminAuditLogHandler(w http.ResponseWriter, req *http.Request) {
+	limit, offset := pageParams(req)
+
+	dbStructure, err := config.db.LoadDB()
+	if err != nil {
+		respondWithError(w, 500, err.Error())
+		return
+	}
+
+	entries := make([]AuditEntry, 0, len(dbStructure.AuditLog))
+	for i := len(dbStructure.AuditLog) - 1; i >= 0; i-- {
+		entries = append(entries, dbStructure.AuditLog[i])
+	}
+
+	total := len(entries)
+	respondWithJSON(w, 200, struct {
+		Entries []AuditEntry `json:"entries"`
+		Total   int          `json:"total"`
+		Limit   int          `json:"limit"`
+		Offset  int          `json:"offset"`
+	}{
+		Entries: entries[min(offset, total):min(offset+limit, total)],
+		Total:   total,
+		Limit:   limit,
+		Offset:  offset,
+	})
+}
+
+/*
+route: /api/users/password-reset
+method: POST
+
+	req body shape: {
+		token string
+		password string
+	}
+*/
+func (config *apiConfig) completePasswordResetHandler(w http.ResponseWriter, req *http.Request) {
+	params, err := decodeJSON(req)
+	if err != nil {
+		respondWithError(w, 500, "error decoding request body")
+		return
+	}
+
+	violations := config.passwordPolicy.Check(params.Password)
+	if violations != nil {
+		respondWithPolicyViolations(w, violations)
+		return
+	}
+
+	err = completePasswordReset(config.db, params.Token, params.Password)
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+
+	w.WriteHeader(204)
+}
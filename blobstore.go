@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+/*
+BlobStore keeps immutable blobs addressed by the SHA-256 of their content, so
+uploading the same file twice stores it once. Keys are lowercase hex.
+*/
+type BlobStore interface {
+	// Put stores everything read from r and returns its key and size. If r
+	// fails the blob isn't stored.
+	Put(r io.Reader) (string, int64, error)
+	Open(key string) (io.ReadCloser, error)
+	// Delete removes the blob unless it was stored, or stored again, at or
+	// after storedBefore, and reports whether it did. That keeps a blob
+	// someone is uploading again right now from being deleted before the
+	// new upload is recorded.
+	Delete(key string, storedBefore time.Time) (bool, error)
+}
+
+var errBlobNotFound = errors.New("blob not found")
+
+var blobKeyPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// localBlobStore keeps blobs on disk under dir, fanned out by the first bytes
+// of the key so no single directory gets too big.
+type localBlobStore struct {
+	dir string
+	// held while a blob is being stored or deleted
+	mux *sync.Mutex
+}
+
+func newLocalBlobStore(dir string) (*localBlobStore, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &localBlobStore{dir: dir, mux: &sync.Mutex{}}, nil
+}
+
+func (store *localBlobStore) path(key string) (string, error) {
+	if !blobKeyPattern.MatchString(key) {
+		return "", errBlobNotFound
+	}
+	return filepath.Join(store.dir, key[:2], key[2:4], key), nil
+}
+
+func (store *localBlobStore) Put(r io.Reader) (string, int64, error) {
+	tmp, err := os.CreateTemp(store.dir, "upload-*")
+	if err != nil {
+		return "", 0, err
+	}
+	// a no-op once the file has been renamed into place
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), r)
+	closeErr := tmp.Close()
+	if err != nil {
+		return "", 0, err
+	}
+	if closeErr != nil {
+		return "", 0, closeErr
+	}
+
+	key := hex.EncodeToString(hash.Sum(nil))
+	path, _ := store.path(key)
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return "", 0, err
+	}
+
+	store.mux.Lock()
+	defer store.mux.Unlock()
+	// already stored; mark it as stored again instead of rewriting it
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err == nil {
+		return key, size, nil
+	}
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return key, size, nil
+}
+
+func (store *localBlobStore) Open(key string) (io.ReadCloser, error) {
+	path, err := store.path(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errBlobNotFound
+	}
+	return file, err
+}
+
+func (store *localBlobStore) Delete(key string, storedBefore time.Time) (bool, error) {
+	path, err := store.path(key)
+	if err != nil {
+		return false, err
+	}
+
+	store.mux.Lock()
+	defer store.mux.Unlock()
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !info.ModTime().Before(storedBefore) {
+		return false, nil
+	}
+	err = os.Remove(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+	return true, nil
+}
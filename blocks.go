@@ -0,0 +1,262 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+Restriction is a block or a mute, stored under the user who made it. A block
+hides the two users from each other both ways and ends any follow between
+them; a mute only hides the muted user from the muter's timelines, search and
+notifications, and the muted user can't tell.
+*/
+type Restriction struct {
+	UserID    int       `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+var (
+	errBlockSelf     = errors.New("you can't block yourself")
+	errMuteSelf      = errors.New("you can't mute yourself")
+	errFollowBlocked = errors.New("you can't follow this user")
+)
+
+func restrictionKey(restriction Restriction) pageCursor {
+	return pageCursor{CreatedAt: restriction.CreatedAt, ID: restriction.UserID}
+}
+
+func hasRestriction(restrictions []Restriction, userID int) bool {
+	return slices.ContainsFunc(restrictions, func(restriction Restriction) bool {
+		return restriction.UserID == userID
+	})
+}
+
+func (dbStructure DBStructure) isBlocking(blockerID, blockedID int) bool {
+	return hasRestriction(dbStructure.Blocks[blockerID], blockedID)
+}
+
+// isBlocked reports whether either user blocked the other.
+func (dbStructure DBStructure) isBlocked(userID, otherID int) bool {
+	return dbStructure.isBlocking(userID, otherID) || dbStructure.isBlocking(otherID, userID)
+}
+
+func (dbStructure DBStructure) isMuting(muterID, mutedID int) bool {
+	return hasRestriction(dbStructure.Mutes[muterID], mutedID)
+}
+
+/*
+hiddenFrom reports whether a chirp is kept out of what viewerID sees because
+of a block, or of a mute when includeMuted is set. A rechirp counts as being
+by both the rechirper and the original author.
+*/
+func (dbStructure DBStructure) hiddenFrom(viewerID int, chirp Chirp, includeMuted bool) bool {
+	if viewerID == 0 {
+		return false
+	}
+	authors := []int{chirp.AuthorID}
+	if chirp.RechirpOf != 0 {
+		authors = append(authors, dbStructure.Chirps[chirp.RechirpOf].AuthorID)
+	}
+	for _, authorID := range authors {
+		if authorID == viewerID || authorID == 0 {
+			continue
+		}
+		if dbStructure.isBlocked(viewerID, authorID) || (includeMuted && dbStructure.isMuting(viewerID, authorID)) {
+			return true
+		}
+	}
+	return false
+}
+
+func removeRestriction(index map[int][]Restriction, userID, otherID int) {
+	index[userID] = slices.DeleteFunc(index[userID], func(restriction Restriction) bool {
+		return restriction.UserID == otherID
+	})
+	if len(index[userID]) == 0 {
+		delete(index, userID)
+	}
+}
+
+// removeUserRestrictions drops the blocks and mutes made by or against the
+// user, used when the account is purged.
+func (dbStructure *DBStructure) removeUserRestrictions(userID int) {
+	delete(dbStructure.Blocks, userID)
+	delete(dbStructure.Mutes, userID)
+	for otherID := range dbStructure.Blocks {
+		removeRestriction(dbStructure.Blocks, otherID, userID)
+	}
+	for otherID := range dbStructure.Mutes {
+		removeRestriction(dbStructure.Mutes, otherID, userID)
+	}
+}
+
+// removeNotificationsBetween drops the notifications recipientID got because
+// of actorID.
+func (dbStructure *DBStructure) removeNotificationsBetween(recipientID, actorID int) {
+	dbStructure.removeNotifications(func(userID int, notification Notification) bool {
+		return userID == recipientID && notification.ActorID == actorID
+	})
+}
+
+func setBlock(db *DB, blockerID, blockedID int, blocking bool) error {
+	if blockerID == blockedID {
+		return errBlockSelf
+	}
+
+	return db.update(func(dbStructure *DBStructure) error {
+		if _, found := dbStructure.Users[blockedID]; !found {
+			return errors.New("user not found")
+		}
+
+		if !blocking {
+			removeRestriction(dbStructure.Blocks, blockerID, blockedID)
+			return nil
+		}
+		if dbStructure.isBlocking(blockerID, blockedID) {
+			return nil
+		}
+		dbStructure.Blocks[blockerID] = append(dbStructure.Blocks[blockerID], Restriction{UserID: blockedID, CreatedAt: time.Now().UTC()})
+		dbStructure.removeFollow(blockerID, blockedID)
+		dbStructure.removeFollow(blockedID, blockerID)
+		dbStructure.removeNotificationsBetween(blockerID, blockedID)
+		dbStructure.removeNotificationsBetween(blockedID, blockerID)
+		return nil
+	})
+}
+
+func setMute(db *DB, muterID, mutedID int, muting bool) error {
+	if muterID == mutedID {
+		return errMuteSelf
+	}
+
+	return db.update(func(dbStructure *DBStructure) error {
+		if _, found := dbStructure.Users[mutedID]; !found {
+			return errors.New("user not found")
+		}
+
+		if !muting {
+			removeRestriction(dbStructure.Mutes, muterID, mutedID)
+			return nil
+		}
+		if dbStructure.isMuting(muterID, mutedID) {
+			return nil
+		}
+		dbStructure.Mutes[muterID] = append(dbStructure.Mutes[muterID], Restriction{UserID: mutedID, CreatedAt: time.Now().UTC()})
+		dbStructure.removeNotificationsBetween(muterID, mutedID)
+		return nil
+	})
+}
+
+/*
+route: /api/users/{userID}/block and /api/users/{userID}/mute
+method: PUT | DELETE
+
+PUT blocks or mutes the user and DELETE undoes it; both are idempotent.
+Blocking also unfollows in both directions, and unblocking doesn't restore
+the follows.
+
+	req headers: {
+		Authorization string (jwtToken or access token with users:write)
+	}
+*/
+func (config *apiConfig) restrictionHandler(w http.ResponseWriter, req *http.Request) {
+	id, err := config.authenticate(req, scopeUsersWrite)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	userID, ok := pathUserID(w, req)
+	if !ok {
+		return
+	}
+
+	set := req.Method == http.MethodPut
+	blocking := strings.HasSuffix(req.URL.Path, "/block")
+	if blocking {
+		err = setBlock(config.db, id, userID, set)
+	} else {
+		err = setMute(config.db, id, userID, set)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, errBlockSelf) || errors.Is(err, errMuteSelf):
+			respondWithError(w, 400, err.Error())
+		case err.Error() == "user not found":
+			respondWithError(w, 404, err.Error())
+		default:
+			respondWithError(w, 500, err.Error())
+		}
+		return
+	}
+	if blocking {
+		config.timelines.Invalidate(id)
+		config.timelines.Invalidate(userID)
+	}
+
+	w.WriteHeader(204)
+}
+
+type restrictionPage struct {
+	Users      []Restriction `json:"users"`
+	Count      int           `json:"count"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+	PrevCursor string        `json:"prev_cursor,omitempty"`
+}
+
+/*
+route: /api/users/me/blocks and /api/users/me/mutes ?limit={optional}&cursor={optional}
+method: GET
+
+The users you've blocked or muted, newest first.
+
+	req headers: {
+		Authorization string (jwtToken or access token with users:write)
+	}
+*/
+func (config *apiConfig) restrictionListHandler(w http.ResponseWriter, req *http.Request) {
+	id, err := config.authenticate(req, scopeUsersWrite)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	limit, cursor, err := pageRequest(req, "restrictions")
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+
+	dbStructure, err := config.db.LoadDB()
+	if err != nil {
+		respondWithError(w, 500, err.Error())
+		return
+	}
+
+	restrictions := dbStructure.Mutes[id]
+	if strings.HasSuffix(req.URL.Path, "/blocks") {
+		restrictions = dbStructure.Blocks[id]
+	}
+	restrictions = slices.Clone(restrictions)
+	sort.Slice(restrictions, func(i, j int) bool {
+		return byTimeDesc(restrictionKey(restrictions[i]), restrictionKey(restrictions[j]))
+	})
+
+	page, next, prev := paginate(restrictions, restrictionKey, byTimeDesc, limit, cursor)
+	nextCursor, prevCursor := pageLinks(w, req, "restrictions", next, prev)
+	if page == nil {
+		page = []Restriction{}
+	}
+
+	respondWithJSON(w, 200, restrictionPage{
+		Users:      page,
+		Count:      len(restrictions),
+		NextCursor: nextCursor,
+		PrevCursor: prevCursor,
+	})
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"image"
+	"math"
+	"strings"
+)
+
+const blurhashCharacters = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+/*
+encodeBlurhash encodes img as a BlurHash (https://blurha.sh): a short string
+clients turn into a blurry placeholder while the real image loads. It's the
+image's first componentsX by componentsY cosine components, so it should be
+given a small copy of the image.
+*/
+func encodeBlurhash(img *image.RGBA, componentsX, componentsY int) string {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+
+	factors := make([][3]float64, 0, componentsX*componentsY)
+	for j := 0; j < componentsY; j++ {
+		for i := 0; i < componentsX; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+
+			var factor [3]float64
+			for y := 0; y < height; y++ {
+				basisY := math.Cos(math.Pi * float64(j) * float64(y) / float64(height))
+				row := img.Pix[y*img.Stride:]
+				for x := 0; x < width; x++ {
+					basis := normalisation * basisY * math.Cos(math.Pi*float64(i)*float64(x)/float64(width))
+					for c := 0; c < 3; c++ {
+						factor[c] += basis * srgbToLinear(row[x*4+c])
+					}
+				}
+			}
+			scale := 1 / float64(width*height)
+			for c := 0; c < 3; c++ {
+				factor[c] *= scale
+			}
+			factors = append(factors, factor)
+		}
+	}
+
+	hash := &strings.Builder{}
+	encodeBase83(hash, (componentsX-1)+(componentsY-1)*9, 1)
+
+	maximum := 1.0
+	if len(factors) > 1 {
+		actualMaximum := 0.0
+		for _, factor := range factors[1:] {
+			for _, value := range factor {
+				actualMaximum = math.Max(actualMaximum, math.Abs(value))
+			}
+		}
+		quantisedMaximum := int(math.Max(0, math.Min(82, math.Floor(actualMaximum*166-0.5))))
+		maximum = float64(quantisedMaximum+1) / 166
+		encodeBase83(hash, quantisedMaximum, 1)
+	} else {
+		encodeBase83(hash, 0, 1)
+	}
+
+	dc := factors[0]
+	encodeBase83(hash, linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4)
+	for _, factor := range factors[1:] {
+		value := 0
+		for _, component := range factor {
+			quantised := math.Floor(signedPow(component/maximum, 0.5)*9 + 9.5)
+			value = value*19 + int(math.Max(0, math.Min(18, quantised)))
+		}
+		encodeBase83(hash, value, 2)
+	}
+	return hash.String()
+}
+
+func encodeBase83(hash *strings.Builder, value, length int) {
+	for i := length - 1; i >= 0; i-- {
+		digit := value / int(math.Pow(83, float64(i))) % 83
+		hash.WriteByte(blurhashCharacters[digit])
+	}
+}
+
+func srgbToLinear(value uint8) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signedPow(value, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exp), value)
+}
@@ -0,0 +1,519 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+/*
+Bookmark is a chirp a user saved for later, stored under that user and never
+shown to anyone else. It may be filed into one of the user's collections. A
+bookmark outlives its chirp: once the chirp is deleted, or the user can no
+longer see it, the bookmark is listed as unavailable until they remove it.
+*/
+type Bookmark struct {
+	ChirpID int `json:"chirp_id"`
+	// 0 when the bookmark isn't in a collection
+	CollectionID int       `json:"collection_id,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Collection is a named, private folder of bookmarks.
+type Collection struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type bookmarkResponse struct {
+	Bookmark
+	Unavailable bool   `json:"unavailable,omitempty"`
+	Chirp       *Chirp `json:"chirp,omitempty"`
+}
+
+type collectionResponse struct {
+	Collection
+	BookmarkCount int `json:"bookmark_count"`
+}
+
+const (
+	maxCollectionNameLength = 50
+	maxCollectionsPerUser   = 100
+)
+
+var (
+	errCollectionNotFound    = errors.New("collection not found")
+	errInvalidCollectionName = errors.New("name must be between 1 and 50 characters")
+	errCollectionNameTaken   = errors.New("you already have a collection with that name")
+	errTooManyCollections    = errors.New("you can have at most 100 collections")
+)
+
+func bookmarkKey(bookmark Bookmark) pageCursor {
+	return pageCursor{CreatedAt: bookmark.CreatedAt, ID: bookmark.ChirpID}
+}
+
+func (dbStructure DBStructure) findCollection(userID, collectionID int) (Collection, bool) {
+	index := slices.IndexFunc(dbStructure.Collections[userID], func(collection Collection) bool {
+		return collection.ID == collectionID
+	})
+	if index == -1 {
+		return Collection{}, false
+	}
+	return dbStructure.Collections[userID][index], true
+}
+
+// checkCollectionName reports whether name can be used for one of userID's
+// collections other than exceptID. Names are unique ignoring case.
+func (dbStructure DBStructure) checkCollectionName(userID, exceptID int, name string) error {
+	if name == "" || utf8.RuneCountInString(name) > maxCollectionNameLength {
+		return errInvalidCollectionName
+	}
+	for _, collection := range dbStructure.Collections[userID] {
+		if collection.ID != exceptID && strings.EqualFold(collection.Name, name) {
+			return errCollectionNameTaken
+		}
+	}
+	return nil
+}
+
+func newBookmarkResponse(dbStructure DBStructure, viewer chirpViewer, bookmark Bookmark) bookmarkResponse {
+	chirp, found := dbStructure.Chirps[bookmark.ChirpID]
+	if !found || !canViewChirp(dbStructure, viewer, chirp, readDirect) {
+		return bookmarkResponse{Bookmark: bookmark, Unavailable: true}
+	}
+	chirps := []Chirp{chirp}
+	prepareChirps(dbStructure, viewer, chirps)
+	return bookmarkResponse{Bookmark: bookmark, Chirp: &chirps[0]}
+}
+
+// removeUserBookmarks drops a purged user's bookmarks and collections.
+// Bookmarks others made of the user's chirps stay and show as unavailable.
+func (dbStructure *DBStructure) removeUserBookmarks(userID int) {
+	delete(dbStructure.Bookmarks, userID)
+	delete(dbStructure.Collections, userID)
+}
+
+/*
+setBookmark bookmarks the chirp for viewer, or files an existing bookmark into
+collectionID (0 takes it out of its collection). Bookmarking a rechirp saves
+the original.
+*/
+func setBookmark(db *DB, viewer chirpViewer, chirpID, collectionID int) (bookmarkResponse, error) {
+	userID := viewer.ID
+	response := bookmarkResponse{}
+	err := db.update(func(dbStructure *DBStructure) error {
+		chirp, found := dbStructure.Chirps[chirpID]
+		if !found || !canViewChirp(*dbStructure, viewer, chirp, readDirect) {
+			return errors.New("Chirp not found")
+		}
+		if chirp.RechirpOf != 0 {
+			chirp, found = dbStructure.Chirps[chirp.RechirpOf]
+			if !found || !canViewChirp(*dbStructure, viewer, chirp, readDirect) {
+				return errors.New("Chirp not found")
+			}
+		}
+		if collectionID != 0 {
+			if _, found := dbStructure.findCollection(userID, collectionID); !found {
+				return errCollectionNotFound
+			}
+		}
+
+		bookmarks := dbStructure.Bookmarks[userID]
+		index := slices.IndexFunc(bookmarks, func(bookmark Bookmark) bool {
+			return bookmark.ChirpID == chirp.ID
+		})
+		if index == -1 {
+			bookmarks = append(bookmarks, Bookmark{ChirpID: chirp.ID, CreatedAt: time.Now().UTC()})
+			index = len(bookmarks) - 1
+		}
+		bookmarks[index].CollectionID = collectionID
+		dbStructure.Bookmarks[userID] = bookmarks
+
+		response = newBookmarkResponse(*dbStructure, viewer, bookmarks[index])
+		return nil
+	})
+	if err != nil {
+		return bookmarkResponse{}, err
+	}
+	return response, nil
+}
+
+// removeBookmark works on bookmarks of chirps that are gone, so it doesn't
+// look the chirp up.
+func removeBookmark(db *DB, userID, chirpID int) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		dbStructure.Bookmarks[userID] = slices.DeleteFunc(dbStructure.Bookmarks[userID], func(bookmark Bookmark) bool {
+			return bookmark.ChirpID == chirpID
+		})
+		if len(dbStructure.Bookmarks[userID]) == 0 {
+			delete(dbStructure.Bookmarks, userID)
+		}
+		return nil
+	})
+}
+
+/*
+route: /api/chirps/{chirpID}/bookmark
+method: PUT | DELETE
+
+PUT bookmarks the chirp, or moves an existing bookmark into collection_id
+(0 or left out for none). DELETE removes the bookmark, even once the chirp is
+gone; both are idempotent.
+
+	req body shape (PUT): {
+		collection_id int
+	}
+
+	req headers: {
+		Authorization string (jwtToken or access token with chirps:write)
+	}
+*/
+func (config *apiConfig) bookmarkHandler(w http.ResponseWriter, req *http.Request) {
+	id, scopes, err := config.authenticateWithScopes(req, scopeChirpsWrite)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	chirpID, err := strconv.Atoi(req.PathValue("chirpID"))
+	if err != nil {
+		respondWithError(w, 400, "invalid chirp id")
+		return
+	}
+
+	if req.Method == http.MethodDelete {
+		err = removeBookmark(config.db, id, chirpID)
+		if err != nil {
+			respondWithError(w, 500, err.Error())
+			return
+		}
+		w.WriteHeader(204)
+		return
+	}
+
+	params := parameters{}
+	if req.ContentLength != 0 {
+		params, err = decodeJSON(req)
+		if err != nil {
+			respondWithError(w, 500, "error decoding request body")
+			return
+		}
+	}
+
+	bookmark, err := setBookmark(config.db, chirpViewer{ID: id, Scopes: scopes}, chirpID, params.CollectionID)
+	if err != nil {
+		switch {
+		case err.Error() == "Chirp not found" || errors.Is(err, errCollectionNotFound):
+			respondWithError(w, 404, err.Error())
+		default:
+			respondWithError(w, 500, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, 200, bookmark)
+}
+
+type bookmarkPage struct {
+	Bookmarks  []bookmarkResponse `json:"bookmarks"`
+	Count      int                `json:"count"`
+	NextCursor string             `json:"next_cursor,omitempty"`
+	PrevCursor string             `json:"prev_cursor,omitempty"`
+}
+
+/*
+route: /api/users/me/bookmarks?collection_id={optional}&limit={optional}&cursor={optional}
+method: GET
+
+Your bookmarks, newest first, optionally only those in one collection.
+Bookmarks of chirps that were deleted or that you can no longer see have
+unavailable set and no chirp.
+
+	req headers: {
+		Authorization string (jwtToken or access token with chirps:read)
+	}
+*/
+func (config *apiConfig) getBookmarksHandler(w http.ResponseWriter, req *http.Request) {
+	id, scopes, err := config.authenticateWithScopes(req, scopeChirpsRead)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	collectionID := 0
+	if collectionText := req.URL.Query().Get("collection_id"); collectionText != "" {
+		collectionID, err = strconv.Atoi(collectionText)
+		if err != nil {
+			respondWithError(w, 400, "invalid collection id")
+			return
+		}
+	}
+
+	limit, cursor, err := pageRequest(req, "bookmarks")
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+
+	dbStructure, err := config.db.LoadDB()
+	if err != nil {
+		respondWithError(w, 500, err.Error())
+		return
+	}
+
+	bookmarks := slices.Clone(dbStructure.Bookmarks[id])
+	if collectionID != 0 {
+		if _, found := dbStructure.findCollection(id, collectionID); !found {
+			respondWithError(w, 404, errCollectionNotFound.Error())
+			return
+		}
+		bookmarks = slices.DeleteFunc(bookmarks, func(bookmark Bookmark) bool {
+			return bookmark.CollectionID != collectionID
+		})
+	}
+	sort.Slice(bookmarks, func(i, j int) bool {
+		return byTimeDesc(bookmarkKey(bookmarks[i]), bookmarkKey(bookmarks[j]))
+	})
+
+	page, next, prev := paginate(bookmarks, bookmarkKey, byTimeDesc, limit, cursor)
+	nextCursor, prevCursor := pageLinks(w, req, "bookmarks", next, prev)
+
+	viewer := chirpViewer{ID: id, Scopes: scopes}
+	responses := make([]bookmarkResponse, 0, len(page))
+	for _, bookmark := range page {
+		responses = append(responses, newBookmarkResponse(dbStructure, viewer, bookmark))
+	}
+
+	respondWithJSON(w, 200, bookmarkPage{
+		Bookmarks:  responses,
+		Count:      len(bookmarks),
+		NextCursor: nextCursor,
+		PrevCursor: prevCursor,
+	})
+}
+
+func pathCollectionID(w http.ResponseWriter, req *http.Request) (int, bool) {
+	collectionID, err := strconv.Atoi(req.PathValue("collectionID"))
+	if err != nil {
+		respondWithError(w, 400, "invalid collection id")
+		return 0, false
+	}
+	return collectionID, true
+}
+
+func respondWithCollectionError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errInvalidCollectionName) || errors.Is(err, errTooManyCollections):
+		respondWithError(w, 400, err.Error())
+	case errors.Is(err, errCollectionNotFound):
+		respondWithError(w, 404, err.Error())
+	case errors.Is(err, errCollectionNameTaken):
+		respondWithError(w, 409, err.Error())
+	default:
+		respondWithError(w, 500, err.Error())
+	}
+}
+
+func (dbStructure DBStructure) newCollectionResponse(userID int, collection Collection) collectionResponse {
+	response := collectionResponse{Collection: collection}
+	for _, bookmark := range dbStructure.Bookmarks[userID] {
+		if bookmark.CollectionID == collection.ID {
+			response.BookmarkCount++
+		}
+	}
+	return response
+}
+
+/*
+route: /api/users/me/collections
+method: POST
+
+	req body shape: {
+		name string
+	}
+
+	req headers: {
+		Authorization string (jwtToken or access token with chirps:write)
+	}
+*/
+func (config *apiConfig) createCollectionHandler(w http.ResponseWriter, req *http.Request) {
+	id, err := config.authenticate(req, scopeChirpsWrite)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	params, err := decodeJSON(req)
+	if err != nil {
+		respondWithError(w, 500, "error decoding request body")
+		return
+	}
+	name := strings.TrimSpace(params.Name)
+
+	collection := Collection{}
+	err = config.db.update(func(dbStructure *DBStructure) error {
+		if len(dbStructure.Collections[id]) >= maxCollectionsPerUser {
+			return errTooManyCollections
+		}
+		err := dbStructure.checkCollectionName(id, 0, name)
+		if err != nil {
+			return err
+		}
+
+		dbStructure.LastCollectionID++
+		collection = Collection{ID: dbStructure.LastCollectionID, Name: name, CreatedAt: time.Now().UTC()}
+		dbStructure.Collections[id] = append(dbStructure.Collections[id], collection)
+		return nil
+	})
+	if err != nil {
+		respondWithCollectionError(w, err)
+		return
+	}
+
+	respondWithJSON(w, 201, collectionResponse{Collection: collection})
+}
+
+/*
+route: /api/users/me/collections
+method: GET
+
+Your collections in the order you made them, with how many bookmarks each
+holds.
+
+	req headers: {
+		Authorization string (jwtToken or access token with chirps:read)
+	}
+*/
+func (config *apiConfig) getCollectionsHandler(w http.ResponseWriter, req *http.Request) {
+	id, err := config.authenticate(req, scopeChirpsRead)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	dbStructure, err := config.db.LoadDB()
+	if err != nil {
+		respondWithError(w, 500, err.Error())
+		return
+	}
+
+	collections := []collectionResponse{}
+	for _, collection := range dbStructure.Collections[id] {
+		collections = append(collections, dbStructure.newCollectionResponse(id, collection))
+	}
+
+	respondWithJSON(w, 200, collections)
+}
+
+/*
+route: /api/users/me/collections/{collectionID}
+method: PUT
+
+Renames the collection.
+
+	req body shape: {
+		name string
+	}
+
+	req headers: {
+		Authorization string (jwtToken or access token with chirps:write)
+	}
+*/
+func (config *apiConfig) renameCollectionHandler(w http.ResponseWriter, req *http.Request) {
+	id, err := config.authenticate(req, scopeChirpsWrite)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	collectionID, ok := pathCollectionID(w, req)
+	if !ok {
+		return
+	}
+
+	params, err := decodeJSON(req)
+	if err != nil {
+		respondWithError(w, 500, "error decoding request body")
+		return
+	}
+	name := strings.TrimSpace(params.Name)
+
+	response := collectionResponse{}
+	err = config.db.update(func(dbStructure *DBStructure) error {
+		index := slices.IndexFunc(dbStructure.Collections[id], func(collection Collection) bool {
+			return collection.ID == collectionID
+		})
+		if index == -1 {
+			return errCollectionNotFound
+		}
+		err := dbStructure.checkCollectionName(id, collectionID, name)
+		if err != nil {
+			return err
+		}
+
+		dbStructure.Collections[id][index].Name = name
+		response = dbStructure.newCollectionResponse(id, dbStructure.Collections[id][index])
+		return nil
+	})
+	if err != nil {
+		respondWithCollectionError(w, err)
+		return
+	}
+
+	respondWithJSON(w, 200, response)
+}
+
+/*
+route: /api/users/me/collections/{collectionID}
+method: DELETE
+
+Deletes the collection. The bookmarks in it are kept, just no longer filed
+anywhere.
+
+	req headers: {
+		Authorization string (jwtToken or access token with chirps:write)
+	}
+*/
+func (config *apiConfig) deleteCollectionHandler(w http.ResponseWriter, req *http.Request) {
+	id, err := config.authenticate(req, scopeChirpsWrite)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	collectionID, ok := pathCollectionID(w, req)
+	if !ok {
+		return
+	}
+
+	err = config.db.update(func(dbStructure *DBStructure) error {
+		if _, found := dbStructure.findCollection(id, collectionID); !found {
+			return errCollectionNotFound
+		}
+
+		dbStructure.Collections[id] = slices.DeleteFunc(dbStructure.Collections[id], func(collection Collection) bool {
+			return collection.ID == collectionID
+		})
+		if len(dbStructure.Collections[id]) == 0 {
+			delete(dbStructure.Collections, id)
+		}
+		for i, bookmark := range dbStructure.Bookmarks[id] {
+			if bookmark.CollectionID == collectionID {
+				dbStructure.Bookmarks[id][i].CollectionID = 0
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		respondWithCollectionError(w, err)
+		return
+	}
+
+	w.WriteHeader(204)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+type ChirpRevision struct {
+	Body string `json:"body"`
+	// when this body was first posted or last edited
+	CreatedAt  time.Time `json:"created_at"`
+	ReplacedAt time.Time `json:"replaced_at"`
+}
+
+type editWindows struct {
+	Standard  time.Duration
+	ChirpyRed time.Duration
+}
+
+var (
+	errNotChirpAuthor    = errors.New("you are not authorized to edit this chirp")
+	errEditWindowExpired = errors.New("this chirp can no longer be edited")
+)
+
+func editWindowsFromEnv() editWindows {
+	return editWindows{
+		Standard:  time.Duration(envInt("CHIRP_EDIT_WINDOW_MINUTES", 15)) * time.Minute,
+		ChirpyRed: time.Duration(envInt("CHIRP_EDIT_WINDOW_RED_MINUTES", 60)) * time.Minute,
+	}
+}
+
+// editChirpInDB replaces the body and keeps the old one as a revision.
+func editChirpInDB(db *DB, windows editWindows, chirpID, authorID int, body string) (Chirp, error) {
+	chirp := Chirp{}
+	err := db.update(func(dbStructure *DBStructure) error {
+		found := false
+		chirp, found = dbStructure.Chirps[chirpID]
+		if !found || chirp.Deleted {
+			return errors.New("Chirp not found")
+		}
+		if chirp.AuthorID != authorID {
+			return errNotChirpAuthor
+		}
+		if chirp.RechirpOf != 0 {
+			return errRechirpNotEditable
+		}
+
+		window := windows.Standard
+		if dbStructure.Users[authorID].IsChirpyRed {
+			window = windows.ChirpyRed
+		}
+		now := time.Now().UTC()
+		if now.After(chirp.CreatedAt.Add(window)) {
+			return errEditWindowExpired
+		}
+
+		dbStructure.ChirpRevisions[chirpID] = append(dbStructure.ChirpRevisions[chirpID], ChirpRevision{
+			Body:       chirp.Body,
+			CreatedAt:  chirp.UpdatedAt,
+			ReplacedAt: now,
+		})
+		dbStructure.unindexHashtags(chirp)
+		alreadyMentioned := mentionedUsers(chirp.Mentions)
+		chirp.Body = body
+		chirp.Hashtags = parseHashtags(body)
+		chirp.Mentions = resolveMentions(*dbStructure, chirp.AuthorID, body)
+		chirp.UpdatedAt = now
+		chirp.Edited = true
+		dbStructure.Chirps[chirpID] = chirp
+		dbStructure.indexHashtags(chirp)
+
+		// only people the edit newly mentions hear about it
+		newlyMentioned := slices.DeleteFunc(mentionedUsers(chirp.Mentions), func(userID int) bool {
+			return slices.Contains(alreadyMentioned, userID)
+		})
+		dbStructure.notifyChirp(chirp, newlyMentioned, false)
+		return nil
+	})
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	return chirp, nil
+}
+
+/*
+route: /api/chirps/{chirpID}
+method: PUT
+
+	req body shape: {
+		body string
+	}
+
+	req headers: {
+		Authorization string (jwtToken or access token with chirps:write)
+	}
+*/
+func (config *apiConfig) editChirpHandler(w http.ResponseWriter, req *http.Request) {
+	id, err := config.authenticate(req, scopeChirpsWrite)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	chirpID, err := strconv.Atoi(req.PathValue("chirpID"))
+	if err != nil {
+		respondWithError(w, 400, "invalid chirp id")
+		return
+	}
+
+	params, err := decodeJSON(req)
+	if err != nil {
+		respondWithError(w, 500, "error decoding request body")
+		return
+	}
+
+	if !validateChirp(params.Body) {
+		respondWithError(w, 400, "chirp is too long")
+		return
+	}
+
+	chirp, err := editChirpInDB(config.db, config.editWindows, chirpID, id, cleanMessage(params.Body))
+	if err != nil {
+		switch {
+		case err.Error() == "Chirp not found":
+			respondWithError(w, 404, err.Error())
+		case errors.Is(err, errNotChirpAuthor), errors.Is(err, errEditWindowExpired):
+			respondWithError(w, 403, err.Error())
+		case errors.Is(err, errRechirpNotEditable):
+			respondWithError(w, 400, err.Error())
+		default:
+			respondWithError(w, 500, err.Error())
+		}
+		return
+	}
+	config.search.Add(chirp)
+
+	chirps := []Chirp{chirp}
+	err = config.prepareChirpsFor(req, chirps)
+	if err != nil {
+		respondWithError(w, 500, err.Error())
+		return
+	}
+
+	respondWithJSON(w, 200, chirps[0])
+}
+
+/*
+route: /api/chirps/{chirpID}/revisions
+method: GET
+
+Earlier bodies of the chirp, oldest first.
+*/
+func (config *apiConfig) getChirpRevisionsHandler(w http.ResponseWriter, req *http.Request) {
+	chirpID, err := strconv.Atoi(req.PathValue("chirpID"))
+	if err != nil {
+		respondWithError(w, 400, "invalid chirp id")
+		return
+	}
+
+	dbStructure, err := config.db.LoadDB()
+	if err != nil {
+		respondWithError(w, 500, err.Error())
+		return
+	}
+
+	chirp, found := dbStructure.Chirps[chirpID]
+	if !found || !canViewChirp(dbStructure, config.optionalViewer(req), chirp, readDirect) {
+		respondWithError(w, 404, "Chirp not found")
+		return
+	}
+
+	revisions := dbStructure.ChirpRevisions[chirpID]
+	if revisions == nil {
+		revisions = []ChirpRevision{}
+	}
+
+	respondWithJSON(w, 200, struct {
+		ChirpID   int             `json:"chirp_id"`
+		Revisions []ChirpRevision `json:"revisions"`
+	}{
+		ChirpID:   chirpID,
+		Revisions: revisions,
+	})
+}
@@ -0,0 +1,298 @@
+/*
+oauthclient is a fake third-party client that runs the whole OAuth 2.0
+authorization-code + PKCE flow against a local Chirpy server:
+
+	go run ./cmd/oauthclient -email user@example.com -password 'secret'
+
+It logs in as the user to register itself, walks through the consent page,
+exchanges the code, posts a chirp with the access token, refreshes, revokes,
+and exits non-zero as soon as any step misbehaves.
+*/
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+	Error        string `json:"error"`
+}
+
+func main() {
+	server := flag.String("server", "http://localhost:8080", "chirpy base url")
+	email := flag.String("email", "", "email of the user granting access")
+	password := flag.String("password", "", "password of the user granting access")
+	scope := flag.String("scope", "chirps:read chirps:write", "space separated scopes to request")
+	public := flag.Bool("public", false, "register as a public client without a secret")
+	flag.Parse()
+
+	if *email == "" || *password == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	err := run(*server, *email, *password, *scope, *public)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("OAuth flow completed successfully")
+}
+
+func run(server, email, password, scope string, public bool) error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	redirectURI := fmt.Sprintf("http://%s/callback", listener.Addr())
+
+	callbacks := make(chan url.Values, 1)
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		callbacks <- req.URL.Query()
+		w.Write([]byte("You can close this window."))
+	}))
+
+	sessionToken, err := login(server, email, password)
+	if err != nil {
+		return err
+	}
+	clientID, clientSecret, err := registerClient(server, sessionToken, redirectURI, public)
+	if err != nil {
+		return err
+	}
+	fmt.Println("registered client", clientID)
+
+	verifier := randomString()
+	sum := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+	state := randomString()
+
+	authorizeParams := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {clientID},
+		"redirect_uri":          {redirectURI},
+		"scope":                 {scope},
+		"state":                 {state},
+		"code_challenge":        {challenge},
+		"code_challenge_method": {"S256"},
+	}
+	res, err := http.Get(server + "/oauth/authorize?" + authorizeParams.Encode())
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("consent page returned %d", res.StatusCode)
+	}
+	fmt.Println("consent page rendered")
+
+	// submit the consent form the way a browser would; the redirect lands
+	// on our local callback listener
+	consent := url.Values{
+		"client_id":      {clientID},
+		"redirect_uri":   {redirectURI},
+		"scope":          {scope},
+		"state":          {state},
+		"code_challenge": {challenge},
+		"email":          {email},
+		"password":       {password},
+		"decision":       {"approve"},
+	}
+	res, err = http.PostForm(server+"/oauth/authorize", consent)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	callback := <-callbacks
+	if callback.Get("state") != state {
+		return errors.New("state mismatch on callback")
+	}
+	if callback.Get("error") != "" {
+		return fmt.Errorf("authorization failed: %s", callback.Get("error"))
+	}
+	fmt.Println("received authorization code")
+
+	tokens, err := requestToken(server, clientID, clientSecret, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {callback.Get("code")},
+		"redirect_uri":  {redirectURI},
+		"code_verifier": {verifier},
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println("exchanged code for tokens with scope", tokens.Scope)
+
+	_, err = requestToken(server, clientID, clientSecret, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {callback.Get("code")},
+		"redirect_uri":  {redirectURI},
+		"code_verifier": {verifier},
+	})
+	if err == nil {
+		return errors.New("authorization code was accepted twice")
+	}
+	fmt.Println("replayed code was rejected")
+
+	if strings.Contains(scope, "chirps:write") {
+		status, err := postChirp(server, tokens.AccessToken, "posted by a fake oauth client")
+		if err != nil {
+			return err
+		}
+		if status != 201 {
+			return fmt.Errorf("posting a chirp returned %d", status)
+		}
+		fmt.Println("posted a chirp with the access token")
+	}
+
+	refreshed, err := requestToken(server, clientID, clientSecret, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {tokens.RefreshToken},
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println("refreshed access token")
+
+	form := url.Values{"token": {refreshed.RefreshToken}}
+	res, err = postTokenEndpoint(server+"/oauth/revoke", clientID, clientSecret, form)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("revocation returned %d", res.StatusCode)
+	}
+
+	_, err = requestToken(server, clientID, clientSecret, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshed.RefreshToken},
+	})
+	if err == nil {
+		return errors.New("revoked refresh token still works")
+	}
+	fmt.Println("revoked refresh token")
+
+	return nil
+}
+
+func login(server, email, password string) (string, error) {
+	body, _ := json.Marshal(map[string]string{"email": email, "password": password})
+	res, err := http.Post(server+"/api/login", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return "", fmt.Errorf("login returned %d", res.StatusCode)
+	}
+
+	response := struct {
+		Token string `json:"token"`
+	}{}
+	err = json.NewDecoder(res.Body).Decode(&response)
+	return response.Token, err
+}
+
+func registerClient(server, sessionToken, redirectURI string, public bool) (string, string, error) {
+	body, _ := json.Marshal(map[string]any{
+		"name":          "Fake OAuth Client",
+		"redirect_uris": []string{redirectURI},
+		"public":        public,
+	})
+	req, err := http.NewRequest("POST", server+"/api/oauth/clients", bytes.NewReader(body))
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+sessionToken)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 201 {
+		return "", "", fmt.Errorf("client registration returned %d", res.StatusCode)
+	}
+
+	response := struct {
+		ClientID     string `json:"client_id"`
+		ClientSecret string `json:"client_secret"`
+	}{}
+	err = json.NewDecoder(res.Body).Decode(&response)
+	return response.ClientID, response.ClientSecret, err
+}
+
+func postTokenEndpoint(endpoint, clientID, clientSecret string, form url.Values) (*http.Response, error) {
+	if clientSecret == "" {
+		form.Set("client_id", clientID)
+	}
+	req, err := http.NewRequest("POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if clientSecret != "" {
+		req.SetBasicAuth(clientID, clientSecret)
+	}
+	return http.DefaultClient.Do(req)
+}
+
+func requestToken(server, clientID, clientSecret string, form url.Values) (tokenResponse, error) {
+	res, err := postTokenEndpoint(server+"/oauth/token", clientID, clientSecret, form)
+	if err != nil {
+		return tokenResponse{}, err
+	}
+	defer res.Body.Close()
+
+	response := tokenResponse{}
+	err = json.NewDecoder(res.Body).Decode(&response)
+	if err != nil {
+		return tokenResponse{}, err
+	}
+	if res.StatusCode != 200 {
+		return tokenResponse{}, fmt.Errorf("token endpoint returned %d: %s", res.StatusCode, response.Error)
+	}
+	return response, nil
+}
+
+func postChirp(server, accessToken, body string) (int, error) {
+	payload, _ := json.Marshal(map[string]string{"body": body})
+	req, err := http.NewRequest("POST", server+"/api/chirps", bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	return res.StatusCode, nil
+}
+
+func randomString() string {
+	bytes := make([]byte, 32)
+	rand.Read(bytes)
+	return base64.RawURLEncoding.EncodeToString(bytes)
+}
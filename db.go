@@ -6,23 +6,67 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"slices"
 	"sort"
 	"strconv"
 	"sync"
 	"time"
-
-	"golang.org/x/crypto/bcrypt"
 )
 
 type DB struct {
-	path string
-	mux  *sync.Mutex
+	path   string
+	mux    *sync.Mutex
+	hasher PasswordHasher
 }
 
 type Chirp struct {
-	ID       int    `json:"id"`
-	Body     string `json:"body"`
-	AuthorID int    `json:"author_id"`
+	ID        int       `json:"id"`
+	Body      string    `json:"body"`
+	AuthorID  int       `json:"author_id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// hidden by a moderator; only the author and moderators can see it
+	Hidden bool `json:"hidden,omitempty"`
+	// public, followers or unlisted; see canViewChirp
+	Visibility string `json:"visibility"`
+	// set once the author has changed the body; earlier bodies are kept in
+	// DBStructure.ChirpRevisions
+	Edited bool `json:"edited"`
+	// id of the chirp this one replies to, 0 for top-level chirps
+	InReplyTo  int `json:"in_reply_to,omitempty"`
+	ReplyCount int `json:"reply_count"`
+	// a deleted chirp that still has replies is kept as an empty tombstone
+	// so its thread stays intact
+	Deleted bool `json:"deleted,omitempty"`
+	// reaction counts by name
+	Reactions map[string]int `json:"reactions,omitempty"`
+	// reactions left by the user making the request; filled in per
+	// response and never stored
+	ViewerReactions []string `json:"viewer_reactions,omitempty"`
+	// lowercased #tags in the body
+	Hashtags []string `json:"hashtags,omitempty"`
+	// @handles in the body that resolved to users when it was saved
+	Mentions []Mention `json:"mentions,omitempty"`
+	// a rechirp has no body of its own and just points at the original; a
+	// quote is a normal chirp that also points at one
+	RechirpOf     int `json:"rechirp_of,omitempty"`
+	QuotedChirpID int `json:"quoted_chirp_id,omitempty"`
+	RechirpCount  int `json:"rechirp_count"`
+	QuoteCount    int `json:"quote_count"`
+	// the chirp RechirpOf or QuotedChirpID refers to; filled in per response
+	// and never stored
+	Original *OriginalChirp `json:"original,omitempty"`
+	// uploads attached to the chirp, in order
+	MediaIDs []string `json:"media_ids,omitempty"`
+	// MediaIDs resolved for the response; never stored
+	Media []mediaResponse `json:"media,omitempty"`
+	// filled in per response and never stored; nil once the author's
+	// account is gone
+	Author *chirpAuthor `json:"author,omitempty"`
+	// set on chirps in a thread the viewer can't see, of which only their
+	// place in the thread is left; never stored
+	Unavailable bool `json:"unavailable,omitempty"`
 }
 
 type User struct {
@@ -31,22 +75,108 @@ type User struct {
 	Password     string       `json:"password"`
 	RefreshToken RefreshToken `json:"refresh_token"`
 	IsChirpyRed  bool         `json:"is_chirpy_red"`
+	Role         string       `json:"role,omitempty"`
+	// suspended users can't log in or act on the API
+	SuspendedAt      *time.Time `json:"suspended_at,omitempty"`
+	SuspensionReason string     `json:"suspension_reason,omitempty"`
+	// set by an admin; login is refused until the reset is completed
+	PasswordResetRequired  bool       `json:"password_reset_required,omitempty"`
+	PasswordResetTokenHash string     `json:"password_reset_token_hash,omitempty"`
+	PasswordResetExpiresAt *time.Time `json:"password_reset_expires_at,omitempty"`
+	// the account and its data are purged once this time has passed
+	DeletionScheduledAt *time.Time          `json:"deletion_scheduled_at,omitempty"`
+	SubscriptionHistory []SubscriptionEvent `json:"subscription_history,omitempty"`
+	// refresh tokens issued to OAuth clients, one per grant
+	ClientRefreshTokens []RefreshToken `json:"client_refresh_tokens,omitempty"`
+	// what @mentions resolve against, unique ignoring case
+	Handle string `json:"handle,omitempty"`
+	// public profile
+	DisplayName   string `json:"display_name,omitempty"`
+	Bio           string `json:"bio,omitempty"`
+	Location      string `json:"location,omitempty"`
+	Website       string `json:"website,omitempty"`
+	AvatarMediaID string `json:"avatar_media_id,omitempty"`
 }
 
 type RefreshToken struct {
 	Token      string    `json:"token"`
 	CreatedAt  time.Time `json:"created_at"`
 	DaysActive int       `json:"days_active"`
+	ClientID   string    `json:"client_id,omitempty"`
+	Scopes     []string  `json:"scopes,omitempty"`
 }
 type DBStructure struct {
-	Chirps map[int]Chirp `json:"chirps"`
-	Users  map[int]User  `json:"users"`
+	Chirps       map[int]Chirp          `json:"chirps"`
+	Users        map[int]User           `json:"users"`
+	AccessTokens map[int]AccessToken    `json:"access_tokens"`
+	OAuthClients map[string]OAuthClient `json:"oauth_clients"`
+	// authorization codes keyed by the hash of the code
+	AuthorizationCodes map[string]AuthorizationCode `json:"authorization_codes"`
+	AuditLog           []AuditEntry                 `json:"audit_log"`
+	ExportJobs         map[string]ExportJob         `json:"export_jobs"`
+	// earlier bodies of edited chirps, oldest first
+	ChirpRevisions map[int][]ChirpRevision `json:"chirp_revisions"`
+	// ids of the direct replies to each chirp
+	ChirpReplies map[int][]int `json:"chirp_replies"`
+	// reactions by chirp id
+	Reactions map[int][]Reaction `json:"reactions"`
+	// the follow graph, indexed from both ends
+	Following map[int][]Follow `json:"following"`
+	Followers map[int][]Follow `json:"followers"`
+	// chirp ids by hashtag
+	Hashtags map[string][]int `json:"hashtags"`
+	// rechirp and quote ids by the id of the original
+	Rechirps map[int][]int `json:"rechirps"`
+	Quotes   map[int][]int `json:"quotes"`
+	// blocks and mutes by the user who made them
+	Blocks map[int][]Restriction `json:"blocks"`
+	Mutes  map[int][]Restriction `json:"mutes"`
+	// bookmarks and bookmark collections by the user who made them
+	Bookmarks        map[int][]Bookmark   `json:"bookmarks"`
+	Collections      map[int][]Collection `json:"collections"`
+	LastCollectionID int                  `json:"last_collection_id"`
+	// uploads by media id
+	Media map[string]Media `json:"media"`
+	// blob keys of removed media, deleted by the media sweeper once unused
+	PendingBlobDeletes []string `json:"pending_blob_deletes,omitempty"`
+	// ids of purged users whose direct messages are still to be removed
+	PendingMessagePurges []int `json:"pending_message_purges,omitempty"`
+	// notifications by recipient, oldest first
+	Notifications      map[int][]Notification `json:"notifications"`
+	LastNotificationID int                    `json:"last_notification_id"`
+	// highest ids ever handed out, so ids of deleted records aren't reused
+	LastUserID  int `json:"last_user_id"`
+	LastChirpID int `json:"last_chirp_id"`
+	// chirp ids ordered by (created_at, id)
+	ChirpTimeline []int `json:"chirp_timeline"`
+	SchemaVersion int   `json:"schema_version"`
+}
+
+// ChirpQuery filters GetChirps. Since is inclusive and Until exclusive; zero
+// values mean no bound.
+type ChirpQuery struct {
+	AuthorID int
+	Sort     string
+	Since    time.Time
+	Until    time.Time
+	// only chirps this viewer can see are returned
+	Viewer chirpViewer
 }
 
-func NewDB(path string) (*DB, error) {
+const (
+	chirpSortAsc           = "asc"
+	chirpSortDesc          = "desc"
+	chirpSortCreatedAt     = "created_at"
+	chirpSortCreatedAtDesc = "-created_at"
+)
+
+const currentSchemaVersion = 3
+
+func NewDB(path string, hasher PasswordHasher) (*DB, error) {
 	db := DB{
-		path: path,
-		mux:  &sync.Mutex{},
+		path:   path,
+		mux:    &sync.Mutex{},
+		hasher: hasher,
 	}
 	err := db.ensureDB()
 
@@ -55,9 +185,91 @@ func NewDB(path string) (*DB, error) {
 		return &DB{}, err
 	}
 
+	err = db.migrate()
+	if err != nil {
+		log.Print(err)
+		return &DB{}, err
+	}
+
 	return &db, nil
 }
 
+// migrate brings databases written by older versions up to date.
+func (db *DB) migrate() error {
+	return db.update(func(dbStructure *DBStructure) error {
+		if dbStructure.SchemaVersion >= currentSchemaVersion {
+			return nil
+		}
+
+		if dbStructure.SchemaVersion < 1 {
+			// version 1: chirp timestamps. Post times were never recorded, so
+			// give existing chirps times that keep their old id order.
+			ids := make([]int, 0, len(dbStructure.Chirps))
+			for id := range dbStructure.Chirps {
+				ids = append(ids, id)
+			}
+			sort.Ints(ids)
+			migratedAt := time.Now().UTC()
+			for i, id := range ids {
+				chirp := dbStructure.Chirps[id]
+				if chirp.CreatedAt.IsZero() {
+					chirp.CreatedAt = migratedAt.Add(time.Duration(i-len(ids)) * time.Millisecond)
+					chirp.UpdatedAt = chirp.CreatedAt
+				}
+				dbStructure.Chirps[id] = chirp
+				dbStructure.LastChirpID = max(dbStructure.LastChirpID, id)
+			}
+			dbStructure.ChirpTimeline = nil
+			for _, id := range ids {
+				dbStructure.addToTimeline(dbStructure.Chirps[id])
+			}
+		}
+
+		// version 2: hashtags, parsed when a chirp is saved
+		if dbStructure.SchemaVersion < 2 {
+			for id, chirp := range dbStructure.Chirps {
+				dbStructure.unindexHashtags(chirp)
+				chirp.Hashtags = parseHashtags(chirp.Body)
+				dbStructure.Chirps[id] = chirp
+				dbStructure.indexHashtags(chirp)
+			}
+		}
+
+		// version 3: visibility; everything posted before it was public
+		if dbStructure.SchemaVersion < 3 {
+			for id, chirp := range dbStructure.Chirps {
+				if chirp.Visibility == "" && !chirp.Deleted {
+					chirp.Visibility = visibilityPublic
+					dbStructure.Chirps[id] = chirp
+				}
+			}
+		}
+
+		dbStructure.SchemaVersion = currentSchemaVersion
+		return nil
+	})
+}
+
+func chirpBefore(a, b Chirp) bool {
+	if a.CreatedAt.Equal(b.CreatedAt) {
+		return a.ID < b.ID
+	}
+	return a.CreatedAt.Before(b.CreatedAt)
+}
+
+func (dbStructure *DBStructure) addToTimeline(chirp Chirp) {
+	i := sort.Search(len(dbStructure.ChirpTimeline), func(i int) bool {
+		return chirpBefore(chirp, dbStructure.Chirps[dbStructure.ChirpTimeline[i]])
+	})
+	dbStructure.ChirpTimeline = slices.Insert(dbStructure.ChirpTimeline, i, chirp.ID)
+}
+
+func (dbStructure *DBStructure) removeFromTimeline(chirpID int) {
+	dbStructure.ChirpTimeline = slices.DeleteFunc(dbStructure.ChirpTimeline, func(id int) bool {
+		return id == chirpID
+	})
+}
+
 func (db *DB) ensureDB() error {
 	_, err := os.Open(db.path)
 	if err != nil {
@@ -80,8 +292,26 @@ func (db *DB) LoadDB() (DBStructure, error) {
 		return DBStructure{}, err
 	}
 	dbStructure := DBStructure{
-		Chirps: make(map[int]Chirp),
-		Users:  make(map[int]User),
+		Chirps:             make(map[int]Chirp),
+		Users:              make(map[int]User),
+		AccessTokens:       make(map[int]AccessToken),
+		OAuthClients:       make(map[string]OAuthClient),
+		AuthorizationCodes: make(map[string]AuthorizationCode),
+		ExportJobs:         make(map[string]ExportJob),
+		ChirpRevisions:     make(map[int][]ChirpRevision),
+		ChirpReplies:       make(map[int][]int),
+		Reactions:          make(map[int][]Reaction),
+		Following:          make(map[int][]Follow),
+		Followers:          make(map[int][]Follow),
+		Hashtags:           make(map[string][]int),
+		Notifications:      make(map[int][]Notification),
+		Rechirps:           make(map[int][]int),
+		Quotes:             make(map[int][]int),
+		Media:              make(map[string]Media),
+		Blocks:             make(map[int][]Restriction),
+		Mutes:              make(map[int][]Restriction),
+		Bookmarks:          make(map[int][]Bookmark),
+		Collections:        make(map[int][]Collection),
 	}
 	if len(fileContent) == 0 {
 		return dbStructure, nil
@@ -94,57 +324,131 @@ func (db *DB) LoadDB() (DBStructure, error) {
 	return dbStructure, nil
 }
 
-func (db *DB) CreateChirp(body string, authorID int) (Chirp, error) {
+func (db *DB) CreateChirp(body string, authorID, inReplyTo int) (Chirp, error) {
 	dbStructure, err := db.LoadDB()
 	if err != nil {
 		return Chirp{}, err
 	}
-	id := len(dbStructure.Chirps) + 1
+	id := dbStructure.LastChirpID
+	for chirpID := range dbStructure.Chirps {
+		id = max(id, chirpID)
+	}
+	id++
+
+	now := time.Now().UTC()
 	chirp := Chirp{
-		Body:     body,
-		ID:       id,
-		AuthorID: authorID,
+		Body:       body,
+		ID:         id,
+		AuthorID:   authorID,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+		InReplyTo:  inReplyTo,
+		Hashtags:   parseHashtags(body),
+		Visibility: visibilityPublic,
 	}
 	return chirp, nil
 }
 
-func (db *DB) GetChirps(authorID int, sortPref string) ([]Chirp, error) {
+func (db *DB) GetChirps(query ChirpQuery) ([]Chirp, error) {
 	dbStructure, err := db.LoadDB()
 	if err != nil {
 		return []Chirp{}, err
 	}
 
+	// the timeline is already in time order, so the time bounds are two
+	// binary searches instead of a scan
+	timeline := dbStructure.ChirpTimeline
+	start := 0
+	if !query.Since.IsZero() {
+		start = sort.Search(len(timeline), func(i int) bool {
+			return !dbStructure.Chirps[timeline[i]].CreatedAt.Before(query.Since)
+		})
+	}
+	end := len(timeline)
+	if !query.Until.IsZero() {
+		end = sort.Search(len(timeline), func(i int) bool {
+			return !dbStructure.Chirps[timeline[i]].CreatedAt.Before(query.Until)
+		})
+	}
+
+	context := readPublicListing
+	if query.AuthorID != 0 {
+		context = readAuthorListing
+	}
 	chirps := []Chirp{}
-	for id := range dbStructure.Chirps {
-		if authorID == 0 {
-			chirps = append(chirps, dbStructure.Chirps[id])
+	for _, id := range timeline[start:max(start, end)] {
+		chirp := dbStructure.Chirps[id]
+		if !canViewChirp(dbStructure, query.Viewer, chirp, context) {
 			continue
 		}
 
-		if authorID == dbStructure.Chirps[id].AuthorID {
-			chirps = append(chirps, dbStructure.Chirps[id])
+		if query.AuthorID == 0 || query.AuthorID == chirp.AuthorID {
+			chirps = append(chirps, chirp)
 		}
 	}
 
-	if sortPref == "asc" || sortPref == "" {
+	switch query.Sort {
+	case chirpSortAsc, "":
 		sort.Slice(chirps, func(i, j int) bool { return chirps[i].ID < chirps[j].ID })
-	} else if sortPref == "desc" {
+	case chirpSortDesc:
 		sort.Slice(chirps, func(i, j int) bool { return chirps[i].ID > chirps[j].ID })
+	case chirpSortCreatedAtDesc:
+		slices.Reverse(chirps)
 	}
 	return chirps, nil
 }
 
-func (db *DB) WriteDB(dbStructure DBStructure) error {
+// update loads the database, applies fn and writes the result back while
+// holding the lock, so concurrent read-modify-write cycles don't clobber
+// each other.
+func (db *DB) update(fn func(dbStructure *DBStructure) error) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.LoadDB()
+	if err != nil {
+		return err
+	}
+
+	err = fn(&dbStructure)
+	if err != nil {
+		return err
+	}
+
+	return db.writeDB(dbStructure)
+}
+
+// writeDB replaces the database file. Only update calls it, with the lock
+// held.
+func (db *DB) writeDB(dbStructure DBStructure) error {
 	data, err := json.Marshal(dbStructure)
 	if err != nil {
 		return err
 	}
 
-	err = os.WriteFile(db.path, data, 0666)
+	return writeFileAtomic(db.path, data)
+}
+
+// writeFileAtomic writes data to a fresh temporary file next to path and
+// renames it over path, so a crash mid-write never leaves a truncated file
+// behind and two writers never share a temporary file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
 	if err != nil {
 		return err
 	}
-	return nil
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
 }
 
 func (db *DB) GetChirpById(id string) (Chirp, error) {
@@ -159,7 +463,7 @@ func (db *DB) GetChirpById(id string) (Chirp, error) {
 	}
 
 	chirp, found := dbStructure.Chirps[integerId]
-	if !found {
+	if !found || chirp.Deleted {
 		return Chirp{}, errors.New("Chirp not found")
 	}
 
@@ -168,60 +472,97 @@ func (db *DB) GetChirpById(id string) (Chirp, error) {
 }
 
 func (db *DB) CreateUser(email, password string) (User, error) {
-	dbStructure, err := db.LoadDB()
-	if err != nil {
-		return User{}, err
-	}
-
-	id := len(dbStructure.Users) + 1
-
-	// make sure duplicate emails are not created
-	for id := range dbStructure.Users {
-		if dbStructure.Users[id].Email == email {
-			return User{}, errors.New("the provided email has already been registered")
-		}
-	}
-	// hash password for storage
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 5)
+	// hash password for storage; it's slow on purpose, so do it before
+	// taking the lock
+	hashedPassword, err := db.hasher.Hash(password)
 
 	if err != nil {
 		return User{}, err
 	}
 
 	user := User{
-		ID:          id,
 		Email:       email,
-		Password:    string(hashedPassword),
+		Password:    hashedPassword,
 		IsChirpyRed: false,
 	}
+	err = db.update(func(dbStructure *DBStructure) error {
+		// make sure duplicate emails are not created
+		for id := range dbStructure.Users {
+			if dbStructure.Users[id].Email == email {
+				return errors.New("the provided email has already been registered")
+			}
+		}
+
+		id := dbStructure.LastUserID
+		for userID := range dbStructure.Users {
+			id = max(id, userID)
+		}
+		user.ID = id + 1
+		dbStructure.Users[user.ID] = user
+		dbStructure.LastUserID = user.ID
+		return nil
+	})
+	if err != nil {
+		return User{}, err
+	}
 
 	return user, nil
 }
 
 func (db *DB) UpdateUserById(id int, email, password string) (User, error) {
-	dbStructure, err := db.LoadDB()
-	if err != nil {
-		return User{}, err
+	// only rehash when a new password was actually sent
+	hashedPassword := ""
+	if password != "" {
+		hashed, err := db.hasher.Hash(password)
+		if err != nil {
+			return User{}, err
+		}
+		hashedPassword = hashed
 	}
 
-	user, found := dbStructure.Users[id]
-	if !found {
-		return User{}, errors.New("invalid id")
-	}
+	user := User{}
+	err := db.update(func(dbStructure *DBStructure) error {
+		found := false
+		user, found = dbStructure.Users[id]
+		if !found {
+			return errors.New("invalid id")
+		}
 
-	user.Email = email
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 5)
+		user.Email = email
+		if hashedPassword != "" {
+			user.Password = hashedPassword
+		}
+		dbStructure.Users[id] = user
+		return nil
+	})
 	if err != nil {
 		return User{}, err
 	}
 
-	user.Password = string(hashedPassword)
+	return user, nil
+}
 
-	dbStructure.Users[id] = user
-	err = db.WriteDB(dbStructure)
+// RehashPassword replaces a user's stored hash with one produced by the
+// currently configured hasher, as long as it is still verifiedHash, the hash
+// password was checked against.
+func (db *DB) RehashPassword(id int, verifiedHash, password string) error {
+	hashedPassword, err := db.hasher.Hash(password)
 	if err != nil {
-		return User{}, err
+		return err
 	}
 
-	return user, nil
+	return db.update(func(dbStructure *DBStructure) error {
+		user, found := dbStructure.Users[id]
+		if !found {
+			return errors.New("user not found")
+		}
+		// the password was changed or reset since it was verified; the new
+		// hash is already current
+		if user.Password != verifiedHash {
+			return nil
+		}
+		user.Password = hashedPassword
+		dbStructure.Users[id] = user
+		return nil
+	})
 }
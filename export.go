@@ -0,0 +1,470 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+type SubscriptionEvent struct {
+	IsChirpyRed bool `json:"is_chirpy_red"`
+	// "polka" for payment webhooks, "admin" for manual changes
+	Source    string    `json:"source"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type ExportJob struct {
+	ID          string     `json:"id"`
+	UserID      int        `json:"user_id"`
+	Status      string     `json:"status"`
+	Error       string     `json:"error,omitempty"`
+	FilePath    string     `json:"file_path,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
+
+const (
+	exportStatusPending = "pending"
+	exportStatusReady   = "ready"
+	exportStatusFailed  = "failed"
+
+	exportDir = "exports"
+)
+
+var errExportRateLimited = errors.New("an export was already requested recently")
+
+type exportSettings struct {
+	// minimum time between two export requests from the same user
+	RateLimit time.Duration
+	// how long a signed download link stays valid
+	LinkLifetime time.Duration
+}
+
+func exportSettingsFromEnv() exportSettings {
+	return exportSettings{
+		RateLimit:    time.Duration(envInt("EXPORT_RATE_LIMIT_HOURS", 24)) * time.Hour,
+		LinkLifetime: time.Duration(envInt("EXPORT_LINK_TTL_MINUTES", 15)) * time.Minute,
+	}
+}
+
+func recordSubscriptionEvent(user *User, source string) {
+	user.SubscriptionHistory = append(user.SubscriptionHistory, SubscriptionEvent{
+		IsChirpyRed: user.IsChirpyRed,
+		Source:      source,
+		CreatedAt:   time.Now().UTC(),
+	})
+}
+
+// createExportJob returns the time until the user may ask again when the
+// request is rate limited.
+func createExportJob(db *DB, userID int, rateLimit time.Duration) (ExportJob, time.Duration, error) {
+	job := ExportJob{
+		ID:        generateRefreshToken()[:32],
+		UserID:    userID,
+		Status:    exportStatusPending,
+		CreatedAt: time.Now().UTC(),
+	}
+	retryAfter := time.Duration(0)
+	// removed once the new job is written, so a failed write can't leave the
+	// old job pointing at a missing file
+	oldFiles := []string{}
+
+	err := db.update(func(dbStructure *DBStructure) error {
+		for id, existing := range dbStructure.ExportJobs {
+			if existing.UserID != userID {
+				continue
+			}
+			// a failed export doesn't use up the user's quota
+			wait := existing.CreatedAt.Add(rateLimit).Sub(job.CreatedAt)
+			if existing.Status != exportStatusFailed && wait > 0 {
+				retryAfter = wait
+				return errExportRateLimited
+			}
+			// only the latest export is kept around
+			if existing.FilePath != "" {
+				oldFiles = append(oldFiles, existing.FilePath)
+			}
+			delete(dbStructure.ExportJobs, id)
+		}
+
+		dbStructure.ExportJobs[job.ID] = job
+		return nil
+	})
+	if err != nil {
+		return ExportJob{}, retryAfter, err
+	}
+	for _, path := range oldFiles {
+		os.Remove(path)
+	}
+
+	return job, 0, nil
+}
+
+func findExportJob(db *DB, jobID string) (ExportJob, error) {
+	dbStructure, err := db.LoadDB()
+	if err != nil {
+		return ExportJob{}, err
+	}
+
+	job, found := dbStructure.ExportJobs[jobID]
+	if !found {
+		return ExportJob{}, errors.New("export not found")
+	}
+
+	return job, nil
+}
+
+func finishExportJob(db *DB, jobID, filePath string, exportErr error) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		job, found := dbStructure.ExportJobs[jobID]
+		if !found {
+			return errors.New("export not found")
+		}
+
+		now := time.Now().UTC()
+		job.CompletedAt = &now
+		if exportErr != nil {
+			job.Status = exportStatusFailed
+			job.Error = exportErr.Error()
+		} else {
+			job.Status = exportStatusReady
+			job.FilePath = filePath
+		}
+		dbStructure.ExportJobs[jobID] = job
+		return nil
+	})
+}
+
+// exportFiles collects everything we hold about the user, one JSON document
+// per file in the archive.
+func exportFiles(dbStructure DBStructure, messageStructure MessageStructure, userID int) (map[string]interface{}, error) {
+	user, found := dbStructure.Users[userID]
+	if !found {
+		return nil, errors.New("user not found")
+	}
+
+	chirps := []Chirp{}
+	for _, chirp := range dbStructure.Chirps {
+		if chirp.AuthorID == userID {
+			chirps = append(chirps, chirp)
+		}
+	}
+	sort.Slice(chirps, func(i, j int) bool { return chirps[i].ID < chirps[j].ID })
+
+	accessTokens := []accessTokenResponse{}
+	for _, accessToken := range dbStructure.AccessTokens {
+		if accessToken.UserID == userID {
+			accessTokens = append(accessTokens, newAccessTokenResponse(accessToken, ""))
+		}
+	}
+	sort.Slice(accessTokens, func(i, j int) bool { return accessTokens[i].ID < accessTokens[j].ID })
+
+	type exportedReaction struct {
+		ChirpID int `json:"chirp_id"`
+		Reaction
+	}
+	reactions := []exportedReaction{}
+	for chirpID, chirpReactions := range dbStructure.Reactions {
+		for _, reaction := range chirpReactions {
+			if reaction.UserID == userID {
+				reactions = append(reactions, exportedReaction{ChirpID: chirpID, Reaction: reaction})
+			}
+		}
+	}
+	sort.Slice(reactions, func(i, j int) bool { return reactions[i].CreatedAt.Before(reactions[j].CreatedAt) })
+
+	following := append([]Follow{}, dbStructure.Following[userID]...)
+	followers := append([]Follow{}, dbStructure.Followers[userID]...)
+
+	notifications := append([]Notification{}, dbStructure.Notifications[userID]...)
+	blocks := append([]Restriction{}, dbStructure.Blocks[userID]...)
+	mutes := append([]Restriction{}, dbStructure.Mutes[userID]...)
+	bookmarks := append([]Bookmark{}, dbStructure.Bookmarks[userID]...)
+	collections := append([]Collection{}, dbStructure.Collections[userID]...)
+
+	media := []Media{}
+	for _, upload := range dbStructure.Media {
+		if upload.OwnerID == userID {
+			media = append(media, upload)
+		}
+	}
+	sort.Slice(media, func(i, j int) bool { return media[i].CreatedAt.Before(media[j].CreatedAt) })
+
+	// only what the user sent; the other side of a conversation is theirs
+	messages := []Message{}
+	for _, conversationMessages := range messageStructure.Messages {
+		for _, message := range conversationMessages {
+			if message.SenderID == userID {
+				messages = append(messages, message)
+			}
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool { return messages[i].ID < messages[j].ID })
+
+	subscriptionHistory := user.SubscriptionHistory
+	if subscriptionHistory == nil {
+		subscriptionHistory = []SubscriptionEvent{}
+	}
+
+	return map[string]interface{}{
+		"profile.json": struct {
+			ID          int    `json:"id"`
+			Email       string `json:"email"`
+			Handle      string `json:"handle"`
+			DisplayName string `json:"display_name"`
+			Bio         string `json:"bio"`
+			Location    string `json:"location"`
+			Website     string `json:"website"`
+			Role        string `json:"role"`
+			IsChirpyRed bool   `json:"is_chirpy_red"`
+		}{
+			ID:          user.ID,
+			Email:       user.Email,
+			Handle:      user.Handle,
+			DisplayName: user.DisplayName,
+			Bio:         user.Bio,
+			Location:    user.Location,
+			Website:     user.Website,
+			Role:        userRole(user),
+			IsChirpyRed: user.IsChirpyRed,
+		},
+		"chirps.json":               chirps,
+		"sessions.json":             userSessions(user),
+		"access_tokens.json":        accessTokens,
+		"reactions.json":            reactions,
+		"following.json":            following,
+		"followers.json":            followers,
+		"notifications.json":        notifications,
+		"blocks.json":               blocks,
+		"mutes.json":                mutes,
+		"bookmarks.json":            bookmarks,
+		"collections.json":          collections,
+		"messages.json":             messages,
+		"media.json":                media,
+		"subscription_history.json": subscriptionHistory,
+	}, nil
+}
+
+func writeExportArchive(path string, files map[string]interface{}) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	archive := zip.NewWriter(file)
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		data, err := json.MarshalIndent(files[name], "", "  ")
+		if err != nil {
+			return err
+		}
+		entry, err := archive.Create(name)
+		if err != nil {
+			return err
+		}
+		_, err = entry.Write(data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return archive.Close()
+}
+
+func (config *apiConfig) runExportJob(job ExportJob) {
+	path := filepath.Join(exportDir, job.ID+".zip")
+
+	exportErr := func() error {
+		err := os.MkdirAll(exportDir, 0700)
+		if err != nil {
+			return err
+		}
+		dbStructure, err := config.db.LoadDB()
+		if err != nil {
+			return err
+		}
+		messageStructure, err := config.messages.Load()
+		if err != nil {
+			return err
+		}
+		files, err := exportFiles(dbStructure, messageStructure, job.UserID)
+		if err != nil {
+			return err
+		}
+		return writeExportArchive(path, files)
+	}()
+	if exportErr != nil {
+		log.Printf("export %s failed: %v", job.ID, exportErr)
+		os.Remove(path)
+	}
+
+	err := finishExportJob(config.db, job.ID, path, exportErr)
+	if err != nil {
+		log.Printf("export %s could not be saved: %v", job.ID, err)
+	}
+}
+
+// resumeExportJobs restarts jobs that were still pending when the server
+// last stopped.
+func (config *apiConfig) resumeExportJobs() {
+	dbStructure, err := config.db.LoadDB()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	for _, job := range dbStructure.ExportJobs {
+		if job.Status == exportStatusPending {
+			go config.runExportJob(job)
+		}
+	}
+}
+
+func (config *apiConfig) signExportLink(jobID string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(config.jwtSecret))
+	fmt.Fprintf(mac, "export:%s:%d", jobID, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (config *apiConfig) exportDownloadURL(jobID string) (string, time.Time) {
+	expiresAt := time.Now().UTC().Add(config.exportSettings.LinkLifetime)
+	expires := expiresAt.Unix()
+	return fmt.Sprintf("/api/exports/%s/download?expires=%d&signature=%s",
+		jobID, expires, config.signExportLink(jobID, expires)), expiresAt
+}
+
+type exportJobResponse struct {
+	ID                string     `json:"id"`
+	Status            string     `json:"status"`
+	Error             string     `json:"error,omitempty"`
+	CreatedAt         time.Time  `json:"created_at"`
+	CompletedAt       *time.Time `json:"completed_at,omitempty"`
+	DownloadURL       string     `json:"download_url,omitempty"`
+	DownloadExpiresAt *time.Time `json:"download_expires_at,omitempty"`
+}
+
+func (config *apiConfig) newExportJobResponse(job ExportJob) exportJobResponse {
+	response := exportJobResponse{
+		ID:          job.ID,
+		Status:      job.Status,
+		Error:       job.Error,
+		CreatedAt:   job.CreatedAt,
+		CompletedAt: job.CompletedAt,
+	}
+	if job.Status == exportStatusReady {
+		downloadURL, expiresAt := config.exportDownloadURL(job.ID)
+		response.DownloadURL = downloadURL
+		response.DownloadExpiresAt = &expiresAt
+	}
+	return response
+}
+
+/*
+route: /api/users/me/export
+method: POST
+
+	req headers: {
+		Authorization string (jwtToken)
+	}
+
+Starts an export job; poll the job until it is ready to get a download link.
+*/
+func (config *apiConfig) startExportHandler(w http.ResponseWriter, req *http.Request) {
+	id, err := config.authenticateSession(req)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	job, retryAfter, err := createExportJob(config.db, id, config.exportSettings.RateLimit)
+	if err != nil {
+		if errors.Is(err, errExportRateLimited) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+			respondWithError(w, 429, err.Error())
+			return
+		}
+		respondWithError(w, 500, err.Error())
+		return
+	}
+
+	go config.runExportJob(job)
+
+	w.Header().Set("Location", "/api/users/me/export/"+job.ID)
+	respondWithJSON(w, 202, config.newExportJobResponse(job))
+}
+
+/*
+route: /api/users/me/export/{jobID}
+method: GET
+
+	req headers: {
+		Authorization string (jwtToken)
+	}
+*/
+func (config *apiConfig) getExportHandler(w http.ResponseWriter, req *http.Request) {
+	id, err := config.authenticateSession(req)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	job, err := findExportJob(config.db, req.PathValue("jobID"))
+	if err != nil || job.UserID != id {
+		respondWithError(w, 404, "export not found")
+		return
+	}
+
+	respondWithJSON(w, 200, config.newExportJobResponse(job))
+}
+
+/*
+route: /api/exports/{jobID}/download?expires={unix time}&signature={hex}
+method: GET
+
+The signed link is the credential, so the download works without headers.
+*/
+func (config *apiConfig) downloadExportHandler(w http.ResponseWriter, req *http.Request) {
+	jobID := req.PathValue("jobID")
+	expires, err := strconv.ParseInt(req.URL.Query().Get("expires"), 10, 64)
+	if err != nil {
+		respondWithError(w, 403, "invalid download link")
+		return
+	}
+
+	expected := config.signExportLink(jobID, expires)
+	if !hmac.Equal([]byte(expected), []byte(req.URL.Query().Get("signature"))) {
+		respondWithError(w, 403, "invalid download link")
+		return
+	}
+	if time.Now().UTC().Unix() > expires {
+		respondWithError(w, 403, "download link has expired")
+		return
+	}
+
+	job, err := findExportJob(config.db, jobID)
+	if err != nil || job.Status != exportStatusReady {
+		respondWithError(w, 404, "export not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="chirpy-export.zip"`)
+	http.ServeFile(w, req, job.FilePath)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Follow is one edge of the follow graph as seen from one end: in Following
+// UserID is the followed user, in Followers it's the follower.
+type Follow struct {
+	UserID    int       `json:"user_id"`
+	CreatedAt time.Time `json:"followed_at"`
+}
+
+var errFollowSelf = errors.New("you can't follow yourself")
+
+func followKey(follow Follow) pageCursor {
+	return pageCursor{CreatedAt: follow.CreatedAt, ID: follow.UserID}
+}
+
+func (dbStructure DBStructure) isFollowing(followerID, followedID int) bool {
+	return slices.ContainsFunc(dbStructure.Following[followerID], func(follow Follow) bool {
+		return follow.UserID == followedID
+	})
+}
+
+func (dbStructure *DBStructure) removeFollow(followerID, followedID int) {
+	dbStructure.Following[followerID] = slices.DeleteFunc(dbStructure.Following[followerID], func(follow Follow) bool {
+		return follow.UserID == followedID
+	})
+	if len(dbStructure.Following[followerID]) == 0 {
+		delete(dbStructure.Following, followerID)
+	}
+	dbStructure.Followers[followedID] = slices.DeleteFunc(dbStructure.Followers[followedID], func(follow Follow) bool {
+		return follow.UserID == followerID
+	})
+	if len(dbStructure.Followers[followedID]) == 0 {
+		delete(dbStructure.Followers, followedID)
+	}
+}
+
+// removeUserFollows drops every edge touching the user, used when the
+// account is purged.
+func (dbStructure *DBStructure) removeUserFollows(userID int) {
+	for _, follow := range slices.Clone(dbStructure.Following[userID]) {
+		dbStructure.removeFollow(userID, follow.UserID)
+	}
+	for _, follow := range slices.Clone(dbStructure.Followers[userID]) {
+		dbStructure.removeFollow(follow.UserID, userID)
+	}
+}
+
+func setFollow(db *DB, followerID, followedID int, following bool) error {
+	if followerID == followedID {
+		return errFollowSelf
+	}
+
+	return db.update(func(dbStructure *DBStructure) error {
+		if _, found := dbStructure.Users[followedID]; !found {
+			return errors.New("user not found")
+		}
+
+		if !following {
+			if dbStructure.isFollowing(followerID, followedID) {
+				dbStructure.removeFollow(followerID, followedID)
+				dbStructure.removeNotifications(func(userID int, notification Notification) bool {
+					return userID == followedID && notification.Type == notificationFollow && notification.ActorID == followerID
+				})
+			}
+			return nil
+		}
+		if dbStructure.isFollowing(followerID, followedID) {
+			return nil
+		}
+		if dbStructure.isBlocked(followerID, followedID) {
+			return errFollowBlocked
+		}
+		now := time.Now().UTC()
+		dbStructure.Following[followerID] = append(dbStructure.Following[followerID], Follow{UserID: followedID, CreatedAt: now})
+		dbStructure.Followers[followedID] = append(dbStructure.Followers[followedID], Follow{UserID: followerID, CreatedAt: now})
+		dbStructure.notify(followedID, Notification{Type: notificationFollow, ActorID: followerID})
+		return nil
+	})
+}
+
+/*
+route: /api/users/{userID}/follow
+method: PUT | DELETE
+
+PUT follows the user and DELETE unfollows; both are idempotent.
+
+	req headers: {
+		Authorization string (jwtToken or access token with users:write)
+	}
+*/
+func (config *apiConfig) followHandler(w http.ResponseWriter, req *http.Request) {
+	id, err := config.authenticate(req, scopeUsersWrite)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	userID, ok := pathUserID(w, req)
+	if !ok {
+		return
+	}
+
+	following := req.Method == http.MethodPut
+	err = setFollow(config.db, id, userID, following)
+	if err != nil {
+		switch {
+		case errors.Is(err, errFollowSelf):
+			respondWithError(w, 400, err.Error())
+		case errors.Is(err, errFollowBlocked):
+			respondWithError(w, 403, err.Error())
+		case err.Error() == "user not found":
+			respondWithError(w, 404, err.Error())
+		default:
+			respondWithError(w, 500, err.Error())
+		}
+		return
+	}
+	config.timelines.Invalidate(id)
+
+	w.WriteHeader(204)
+}
+
+type followPage struct {
+	Users      []Follow `json:"users"`
+	Count      int      `json:"count"`
+	NextCursor string   `json:"next_cursor,omitempty"`
+	PrevCursor string   `json:"prev_cursor,omitempty"`
+}
+
+/*
+route: /api/users/{userID}/followers and /api/users/{userID}/following ?limit={optional}&cursor={optional}
+method: GET
+
+Newest follows first. count is the total number of followers or followed
+users. Users who blocked the viewer, or whom the viewer blocked, are left out,
+and their own lists aren't found.
+*/
+func (config *apiConfig) followListHandler(w http.ResponseWriter, req *http.Request) {
+	userID, ok := pathUserID(w, req)
+	if !ok {
+		return
+	}
+
+	limit, cursor, err := pageRequest(req, "follows")
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+
+	dbStructure, err := config.db.LoadDB()
+	if err != nil {
+		respondWithError(w, 500, err.Error())
+		return
+	}
+	viewerID := config.optionalViewer(req).ID
+	if _, found := dbStructure.Users[userID]; !found || dbStructure.isBlocked(viewerID, userID) {
+		respondWithError(w, 404, "user not found")
+		return
+	}
+
+	follows := dbStructure.Followers[userID]
+	if strings.HasSuffix(req.URL.Path, "/following") {
+		follows = dbStructure.Following[userID]
+	}
+	follows = slices.DeleteFunc(slices.Clone(follows), func(follow Follow) bool {
+		return dbStructure.isBlocked(viewerID, follow.UserID)
+	})
+	sort.Slice(follows, func(i, j int) bool { return byTimeDesc(followKey(follows[i]), followKey(follows[j])) })
+
+	page, next, prev := paginate(follows, followKey, byTimeDesc, limit, cursor)
+	nextCursor, prevCursor := pageLinks(w, req, "follows", next, prev)
+	if page == nil {
+		page = []Follow{}
+	}
+
+	respondWithJSON(w, 200, followPage{
+		Users:      page,
+		Count:      len(follows),
+		NextCursor: nextCursor,
+		PrevCursor: prevCursor,
+	})
+}
@@ -1,13 +1,13 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"strconv"
 	"strings"
-
-	"golang.org/x/crypto/bcrypt"
+	"time"
 )
 
 type apiConfig struct {
@@ -15,6 +15,17 @@ type apiConfig struct {
 	db             *DB
 	jwtSecret      string
 	polkaKey       string
+	passwordPolicy *passwordPolicy
+	deletionPolicy deletionPolicy
+	exportSettings exportSettings
+	search         *searchIndex
+	editWindows    editWindows
+	timelines      *timelineCache
+	media          mediaSettings
+	blobs          BlobStore
+	// ids of uploads waiting for thumbnails
+	mediaQueue chan string
+	messages   *MessageDB
 }
 
 /*
@@ -70,14 +81,20 @@ method: POST
 
 	req body shape: {
 		body string
+		in_reply_to int (optional)
+		quoted_chirp_id int (optional)
+		media_ids []string (optional, at most 4, from POST /api/media)
+		visibility string (optional: public (default), followers or unlisted)
+	}
+
+	req headers: {
+		Authorization string (jwtToken or access token with chirps:write)
 	}
 */
 func (config *apiConfig) saveChirpsHandler(w http.ResponseWriter, req *http.Request) {
-	jwtToken := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
-	id, err := validateToken(jwtToken)
-
+	id, err := config.authenticate(req, scopeChirpsWrite)
 	if err != nil {
-		respondWithError(w, 401, err.Error())
+		respondWithAuthError(w, err)
 		return
 	}
 
@@ -93,31 +110,116 @@ func (config *apiConfig) saveChirpsHandler(w http.ResponseWriter, req *http.Requ
 		return
 	}
 
-	chirp, err := saveChirpToDB(config.db, cleanMessage(params.Body), id)
+	visibility, err := parseVisibility(params.Visibility)
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+
+	chirp, err := saveChirpToDB(config.db, chirpDraft{
+		Body:          cleanMessage(params.Body),
+		AuthorID:      id,
+		InReplyTo:     params.InReplyTo,
+		QuotedChirpID: params.QuotedChirpID,
+		MediaIDs:      params.MediaIDs,
+		Visibility:    visibility,
+	})
+	if err != nil {
+		if errors.Is(err, errParentNotFound) || errors.Is(err, errQuotedChirpNotFound) ||
+			errors.Is(err, errTooManyMedia) || errors.Is(err, errInvalidMedia) {
+			respondWithError(w, 400, err.Error())
+			return
+		}
+		respondWithError(w, 500, err.Error())
+		return
+	}
+	config.search.Add(chirp)
+	config.fanOutChirp(chirp)
+
+	chirps := []Chirp{chirp}
+	err = config.prepareChirpsFor(req, chirps)
 	if err != nil {
 		respondWithError(w, 500, err.Error())
 		return
 	}
 
-	respondWithJSON(w, 201, chirp)
+	respondWithJSON(w, 201, chirps[0])
+}
+
+type chirpPage struct {
+	Chirps     []Chirp `json:"chirps"`
+	NextCursor string  `json:"next_cursor,omitempty"`
+	PrevCursor string  `json:"prev_cursor,omitempty"`
 }
 
 /*
-route: /api/chirps?author_id={optional}&sort={asc | desc | optional}
+route: /api/chirps?author_id={optional}&sort={asc | desc | created_at | -created_at | optional}&since={RFC3339, optional}&until={RFC3339, optional}&limit={optional}&cursor={optional}
 method: GET
+
+since is inclusive, until is exclusive. Results are paged: follow next_cursor
+and prev_cursor (or the Link header) to move between pages.
 */
 func (config *apiConfig) getChirpsHandler(w http.ResponseWriter, req *http.Request) {
 	authorID := req.URL.Query().Get("author_id")
 	authorIDnum, _ := strconv.Atoi(authorID)
-	sort := req.URL.Query().Get("sort")
+	query := ChirpQuery{
+		AuthorID: authorIDnum,
+		Sort:     req.URL.Query().Get("sort"),
+		Viewer:   config.optionalViewer(req),
+	}
+
+	switch query.Sort {
+	case "", chirpSortAsc, chirpSortDesc, chirpSortCreatedAt, chirpSortCreatedAtDesc:
+	default:
+		respondWithError(w, 400, "invalid sort")
+		return
+	}
+
+	var err error
+	if since := req.URL.Query().Get("since"); since != "" {
+		query.Since, err = time.Parse(time.RFC3339, since)
+		if err != nil {
+			respondWithError(w, 400, "since must be an RFC 3339 timestamp")
+			return
+		}
+	}
+	if until := req.URL.Query().Get("until"); until != "" {
+		query.Until, err = time.Parse(time.RFC3339, until)
+		if err != nil {
+			respondWithError(w, 400, "until must be an RFC 3339 timestamp")
+			return
+		}
+	}
+
+	sortName := query.Sort
+	if sortName == "" {
+		sortName = chirpSortAsc
+	}
+	limit, cursor, err := pageRequest(req, sortName)
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+
+	chirps, err := config.db.GetChirps(query)
+	if err != nil {
+		respondWithError(w, 500, err.Error())
+		return
+	}
 
-	chirps, err := config.db.GetChirps(authorIDnum, sort)
+	page, next, prev := paginate(chirps, chirpKey, chirpSortLess(sortName), limit, cursor)
+	err = config.prepareChirpsFor(req, page)
 	if err != nil {
 		respondWithError(w, 500, err.Error())
 		return
 	}
+	nextCursor, prevCursor := pageLinks(w, req, sortName, next, prev)
 
-	respondWithJSON(w, 200, chirps)
+	respondWithJSON(w, 200, chirpPage{
+		Chirps:     page,
+		NextCursor: nextCursor,
+		PrevCursor: prevCursor,
+	})
 }
 
 /*
@@ -136,7 +238,21 @@ func (config *apiConfig) getChirpByIdHandler(w http.ResponseWriter, req *http.Re
 		return
 	}
 
-	respondWithJSON(w, 200, chirp)
+	viewer := config.optionalViewer(req)
+	dbStructure, err := config.db.LoadDB()
+	if err != nil {
+		respondWithError(w, 500, err.Error())
+		return
+	}
+	if !canViewChirp(dbStructure, viewer, chirp, readDirect) {
+		respondWithError(w, 404, "Chirp not found")
+		return
+	}
+
+	chirps := []Chirp{chirp}
+	prepareChirps(dbStructure, viewer, chirps)
+
+	respondWithJSON(w, 200, chirps[0])
 }
 
 /*
@@ -155,6 +271,12 @@ func (config *apiConfig) saveUserHandler(w http.ResponseWriter, req *http.Reques
 		return
 	}
 
+	violations := config.passwordPolicy.Check(params.Password)
+	if violations != nil {
+		respondWithPolicyViolations(w, violations)
+		return
+	}
+
 	user, err := saveUserToDB(config.db, params.Email, params.Password)
 	if err != nil {
 		if err.Error() == "the provided email has already been registered" {
@@ -205,12 +327,34 @@ func (config *apiConfig) loginUsersHandler(w http.ResponseWriter, req *http.Requ
 		return
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(foundUser.Password), []byte(params.Password))
+	match, err := config.db.hasher.Verify(foundUser.Password, params.Password)
 	if err != nil {
-		respondWithError(w, 401, err.Error())
+		respondWithError(w, 500, err.Error())
+		return
+	}
+	if !match {
+		respondWithError(w, 401, "incorrect password")
+		return
+	}
+
+	if foundUser.SuspendedAt != nil {
+		respondWithError(w, 403, errAccountSuspended.Error())
+		return
+	}
+	if foundUser.PasswordResetRequired {
+		respondWithError(w, 403, errPasswordResetRequired.Error())
 		return
 	}
 
+	// upgrade hashes made with an old algorithm or cost while we still
+	// have the plaintext password
+	if config.db.hasher.NeedsRehash(foundUser.Password) {
+		err = config.db.RehashPassword(foundUser.ID, foundUser.Password, params.Password)
+		if err != nil {
+			log.Print(err)
+		}
+	}
+
 	token, err := createJWT(config.jwtSecret, foundUser.ID)
 
 	if err != nil {
@@ -247,18 +391,18 @@ method: PUT
 
 	req body shape: {
 		email string
-		password string
+		password string (optional, left unchanged when empty)
 	}
 
 	req headers: {
-		Authorization string (jwtToken)
+		Authorization string (jwtToken or access token with users:write)
 	}
 */
 func (config *apiConfig) updateUsersHandler(w http.ResponseWriter, req *http.Request) {
-	jwtToken := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
-	id, err := validateToken(jwtToken)
+	bearer := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	id, err := config.authenticate(req, scopeUsersWrite)
 	if err != nil {
-		respondWithError(w, 401, err.Error())
+		respondWithAuthError(w, err)
 		return
 	}
 
@@ -268,6 +412,14 @@ func (config *apiConfig) updateUsersHandler(w http.ResponseWriter, req *http.Req
 		return
 	}
 
+	if params.Password != "" {
+		violations := config.passwordPolicy.Check(params.Password)
+		if violations != nil {
+			respondWithPolicyViolations(w, violations)
+			return
+		}
+	}
+
 	updatedUser, err := updateUserInDB(config.db, id, params.Email, params.Password)
 	if err != nil {
 		respondWithError(w, 500, "error updating user")
@@ -277,14 +429,17 @@ func (config *apiConfig) updateUsersHandler(w http.ResponseWriter, req *http.Req
 	response := struct {
 		ID          int    `json:"id"`
 		Email       string `json:"email"`
-		Token       string `json:"token"`
+		Token       string `json:"token,omitempty"`
 		IsChirpyRed bool   `json:"is_chirpy_red"`
 	}{
 		ID:          id,
 		Email:       updatedUser.Email,
-		Token:       jwtToken,
 		IsChirpyRed: updatedUser.IsChirpyRed,
 	}
+	// personal access tokens are only ever shown when they're created
+	if !strings.HasPrefix(bearer, accessTokenPrefix) {
+		response.Token = bearer
+	}
 
 	respondWithJSON(w, 200, response)
 }
@@ -341,27 +496,35 @@ route: /api/chirps
 method: DELETE
 
 	req headers: {
-		Authorization: string (JWT)
+		Authorization: string (JWT or access token with chirps:write)
 	}
+
+An access token also needs the admin scope to delete another user's chirp.
 */
 func (config *apiConfig) deleteChirpHandler(w http.ResponseWriter, req *http.Request) {
-	jwtToken := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
-	id, err := validateToken(jwtToken)
+	id, scopes, err := config.authenticateWithScopes(req, scopeChirpsWrite)
 	if err != nil {
-		respondWithError(w, 401, err.Error())
+		respondWithAuthError(w, err)
 		return
 	}
 
 	chirpID := req.PathValue("chirpID")
 	chirp, err := config.db.GetChirpById(chirpID)
 	if err != nil {
+		if err.Error() == "Chirp not found" {
+			respondWithError(w, 404, err.Error())
+			return
+		}
 		respondWithError(w, 500, err.Error())
 		return
 	}
 
 	if id != chirp.AuthorID {
-		respondWithError(w, 403, "you are not authorized to delete this chirp")
-		return
+		user, err := findUserById(config.db, id)
+		if err != nil || !rolesApply(scopes) || !hasPermission(user, permDeleteAnyChirp) {
+			respondWithError(w, 403, "you are not authorized to delete this chirp")
+			return
+		}
 	}
 
 	chirpIDNum, _ := strconv.Atoi(chirpID)
@@ -370,6 +533,7 @@ func (config *apiConfig) deleteChirpHandler(w http.ResponseWriter, req *http.Req
 		respondWithError(w, 500, err.Error())
 		return
 	}
+	config.search.Remove(chirpIDNum)
 
 	w.WriteHeader(204)
 }
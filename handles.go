@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// handles are what @mentions resolve against. They keep the case the user
+// chose but are unique ignoring case.
+var handlePattern = regexp.MustCompile(`^[A-Za-z0-9_]{3,15}$`)
+
+// handles that would be confused with the service itself or with routes
+// like /api/users/me; compared ignoring case
+var reservedHandles = map[string]bool{
+	"about":         true,
+	"admin":         true,
+	"administrator": true,
+	"api":           true,
+	"chirpy":        true,
+	"explore":       true,
+	"help":          true,
+	"home":          true,
+	"login":         true,
+	"logout":        true,
+	"me":            true,
+	"moderator":     true,
+	"notifications": true,
+	"null":          true,
+	"oauth":         true,
+	"root":          true,
+	"search":        true,
+	"security":      true,
+	"settings":      true,
+	"signup":        true,
+	"staff":         true,
+	"support":       true,
+	"system":        true,
+	"trending":      true,
+}
+
+var (
+	errInvalidHandle  = errors.New("handle must be 3 to 15 letters, digits or underscores")
+	errHandleTaken    = errors.New("handle is already taken")
+	errHandleReserved = errors.New("handle is reserved")
+)
+
+func findUserByHandle(dbStructure DBStructure, handle string) (User, bool) {
+	for _, user := range dbStructure.Users {
+		if user.Handle != "" && strings.EqualFold(user.Handle, handle) {
+			return user, true
+		}
+	}
+	return User{}, false
+}
+
+func setHandle(db *DB, userID int, handle string) (User, error) {
+	if !handlePattern.MatchString(handle) {
+		return User{}, errInvalidHandle
+	}
+	if reservedHandles[strings.ToLower(handle)] {
+		return User{}, errHandleReserved
+	}
+
+	user := User{}
+	err := db.update(func(dbStructure *DBStructure) error {
+		found := false
+		user, found = dbStructure.Users[userID]
+		if !found {
+			return errors.New("user not found")
+		}
+		owner, taken := findUserByHandle(*dbStructure, handle)
+		if taken && owner.ID != userID {
+			return errHandleTaken
+		}
+		user.Handle = handle
+		dbStructure.Users[userID] = user
+		return nil
+	})
+	if err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+/*
+route: /api/users/me/handle
+method: PUT
+
+	req body shape: {
+		handle string
+	}
+
+	req headers: {
+		Authorization string (jwtToken or access token with users:write)
+	}
+*/
+func (config *apiConfig) setHandleHandler(w http.ResponseWriter, req *http.Request) {
+	id, err := config.authenticate(req, scopeUsersWrite)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	params, err := decodeJSON(req)
+	if err != nil {
+		respondWithError(w, 500, "error decoding request body")
+		return
+	}
+
+	user, err := setHandle(config.db, id, params.Handle)
+	if err != nil {
+		switch {
+		case errors.Is(err, errInvalidHandle):
+			respondWithError(w, 400, err.Error())
+		case errors.Is(err, errHandleTaken) || errors.Is(err, errHandleReserved):
+			respondWithError(w, 409, err.Error())
+		default:
+			respondWithError(w, 500, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, 200, struct {
+		ID     int    `json:"id"`
+		Email  string `json:"email"`
+		Handle string `json:"handle"`
+	}{
+		ID:     user.ID,
+		Email:  user.Email,
+		Handle: user.Handle,
+	})
+}
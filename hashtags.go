@@ -0,0 +1,218 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const maxHashtagLength = 100
+
+// trendingWindows are the sliding windows /api/trending can rank over. Uses
+// inside a window are weighted by age with a half-life of a quarter of the
+// window, so a tag picking up now outranks one that peaked at the start.
+var trendingWindows = map[string]time.Duration{
+	"1h":  time.Hour,
+	"24h": 24 * time.Hour,
+	"7d":  7 * 24 * time.Hour,
+}
+
+type trendingTag struct {
+	Tag   string  `json:"tag"`
+	Score float64 `json:"score"`
+	Count int     `json:"count"`
+}
+
+func isHashtagRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r) || r == '_'
+}
+
+/*
+parseHashtags returns the distinct #tags in body, lowercased, in the order
+they first appear. A tag has to start a word and contain at least one letter,
+so "#1" and "a#b" aren't tags.
+*/
+func parseHashtags(body string) []string {
+	tags := []string{}
+	previous := ' '
+	for i, r := range body {
+		if r != '#' || isHashtagRune(previous) {
+			previous = r
+			continue
+		}
+		previous = r
+
+		end := i + 1
+		hasLetter := false
+		for end < len(body) {
+			next, size := utf8.DecodeRuneInString(body[end:])
+			if !isHashtagRune(next) {
+				break
+			}
+			hasLetter = hasLetter || unicode.IsLetter(next)
+			end += size
+		}
+		tag := normalizeHashtag(body[i+1 : end])
+		if !hasLetter || utf8.RuneCountInString(tag) > maxHashtagLength || slices.Contains(tags, tag) {
+			continue
+		}
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+func normalizeHashtag(tag string) string {
+	return strings.ToLower(strings.TrimPrefix(tag, "#"))
+}
+
+func (dbStructure *DBStructure) indexHashtags(chirp Chirp) {
+	for _, tag := range chirp.Hashtags {
+		dbStructure.Hashtags[tag] = append(dbStructure.Hashtags[tag], chirp.ID)
+	}
+}
+
+func (dbStructure *DBStructure) unindexHashtags(chirp Chirp) {
+	for _, tag := range chirp.Hashtags {
+		dbStructure.Hashtags[tag] = slices.DeleteFunc(dbStructure.Hashtags[tag], func(id int) bool {
+			return id == chirp.ID
+		})
+		if len(dbStructure.Hashtags[tag]) == 0 {
+			delete(dbStructure.Hashtags, tag)
+		}
+	}
+}
+
+// trendingTags ranks the tags used in the window ending at now.
+func trendingTags(dbStructure DBStructure, window time.Duration, now time.Time) []trendingTag {
+	timeline := dbStructure.ChirpTimeline
+	start := sort.Search(len(timeline), func(i int) bool {
+		return !dbStructure.Chirps[timeline[i]].CreatedAt.Before(now.Add(-window))
+	})
+
+	halfLife := window / 4
+	byTag := make(map[string]*trendingTag)
+	for _, id := range timeline[start:] {
+		chirp := dbStructure.Chirps[id]
+		// only what anyone could find under the tag counts
+		if !canViewChirp(dbStructure, chirpViewer{}, chirp, readPublicListing) || chirp.CreatedAt.After(now) {
+			continue
+		}
+		weight := math.Exp2(-float64(now.Sub(chirp.CreatedAt)) / float64(halfLife))
+		for _, tag := range chirp.Hashtags {
+			if byTag[tag] == nil {
+				byTag[tag] = &trendingTag{Tag: tag}
+			}
+			byTag[tag].Score += weight
+			byTag[tag].Count++
+		}
+	}
+
+	tags := []trendingTag{}
+	for _, tag := range byTag {
+		tags = append(tags, *tag)
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		if tags[i].Score == tags[j].Score {
+			return tags[i].Tag < tags[j].Tag
+		}
+		return tags[i].Score > tags[j].Score
+	})
+	return tags
+}
+
+/*
+route: /api/hashtags/{tag}/chirps?limit={optional}&cursor={optional}
+method: GET
+
+Chirps using the tag, newest first. The tag is matched case-insensitively,
+with or without the leading #.
+*/
+func (config *apiConfig) hashtagChirpsHandler(w http.ResponseWriter, req *http.Request) {
+	tag := normalizeHashtag(req.PathValue("tag"))
+	if tag == "" {
+		respondWithError(w, 400, "invalid hashtag")
+		return
+	}
+
+	limit, cursor, err := pageRequest(req, chirpSortCreatedAtDesc)
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+
+	dbStructure, err := config.db.LoadDB()
+	if err != nil {
+		respondWithError(w, 500, err.Error())
+		return
+	}
+
+	viewer := config.optionalViewer(req)
+	chirps := []Chirp{}
+	for _, id := range dbStructure.Hashtags[tag] {
+		chirp, found := dbStructure.Chirps[id]
+		if !found || !canViewChirp(dbStructure, viewer, chirp, readPublicListing) {
+			continue
+		}
+		chirps = append(chirps, chirp)
+	}
+	sort.Slice(chirps, func(i, j int) bool { return byTimeDesc(chirpKey(chirps[i]), chirpKey(chirps[j])) })
+
+	page, next, prev := paginate(chirps, chirpKey, byTimeDesc, limit, cursor)
+	prepareChirps(dbStructure, viewer, page)
+	nextCursor, prevCursor := pageLinks(w, req, chirpSortCreatedAtDesc, next, prev)
+
+	respondWithJSON(w, 200, chirpPage{
+		Chirps:     page,
+		NextCursor: nextCursor,
+		PrevCursor: prevCursor,
+	})
+}
+
+/*
+route: /api/trending?window={1h | 24h | 7d, optional}&limit={optional}
+method: GET
+
+Tags ranked by time-decayed usage over the window (24h by default).
+*/
+func (config *apiConfig) trendingHandler(w http.ResponseWriter, req *http.Request) {
+	windowName := req.URL.Query().Get("window")
+	if windowName == "" {
+		windowName = "24h"
+	}
+	window, found := trendingWindows[windowName]
+	if !found {
+		respondWithError(w, 400, "window must be one of 1h, 24h, 7d")
+		return
+	}
+
+	limit := 10
+	if limitText := req.URL.Query().Get("limit"); limitText != "" {
+		parsed, err := strconv.Atoi(limitText)
+		if err != nil || parsed <= 0 {
+			respondWithError(w, 400, "limit must be a positive integer")
+			return
+		}
+		limit = min(parsed, maxPageSize)
+	}
+
+	dbStructure, err := config.db.LoadDB()
+	if err != nil {
+		respondWithError(w, 500, err.Error())
+		return
+	}
+
+	tags := trendingTags(dbStructure, window, time.Now().UTC())
+	respondWithJSON(w, 200, struct {
+		Window string        `json:"window"`
+		Tags   []trendingTag `json:"tags"`
+	}{
+		Window: windowName,
+		Tags:   tags[:min(limit, len(tags))],
+	})
+}
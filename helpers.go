@@ -16,10 +16,31 @@ import (
 )
 
 type parameters struct {
-	Body             string `json:"body"`
-	Email            string `json:"email"`
-	Password         string `json:"password"`
-	ExpiresInSeconds int    `json:"expires_in_seconds"`
+	Body             string   `json:"body"`
+	Email            string   `json:"email"`
+	Password         string   `json:"password"`
+	ExpiresInSeconds int      `json:"expires_in_seconds"`
+	Name             string   `json:"name"`
+	Scopes           []string `json:"scopes"`
+	RedirectURIs     []string `json:"redirect_uris"`
+	Public           bool     `json:"public"`
+	Role             string   `json:"role"`
+	Reason           string   `json:"reason"`
+	Token            string   `json:"token"`
+	IsChirpyRed      bool     `json:"is_chirpy_red"`
+	Handle           string   `json:"handle"`
+	InReplyTo        int      `json:"in_reply_to"`
+	QuotedChirpID    int      `json:"quoted_chirp_id"`
+	MediaIDs         []string `json:"media_ids"`
+	Visibility       string   `json:"visibility"`
+	DisplayName      string   `json:"display_name"`
+	Bio              string   `json:"bio"`
+	Location         string   `json:"location"`
+	Website          string   `json:"website"`
+	AvatarMediaID    string   `json:"avatar_media_id"`
+	CollectionID     int      `json:"collection_id"`
+	UserIDs          []int    `json:"user_ids"`
+	MessageID        int      `json:"message_id"`
 	webhookParameters
 }
 
@@ -30,18 +51,61 @@ type webhookParameters struct {
 	} `json:"data"`
 }
 
-func saveChirpToDB(db *DB, body string, authorID int) (Chirp, error) {
-	chirp, err := db.CreateChirp(body, authorID)
-	if err != nil {
-		return Chirp{}, err
-	}
-	dbStructure, err := db.LoadDB()
-	if err != nil {
-		return Chirp{}, err
-	}
-	dbStructure.Chirps[chirp.ID] = chirp
+// chirpDraft is everything a user sends to post a chirp.
+type chirpDraft struct {
+	Body          string
+	AuthorID      int
+	InReplyTo     int
+	QuotedChirpID int
+	MediaIDs      []string
+	Visibility    string
+}
 
-	err = db.WriteDB(dbStructure)
+func saveChirpToDB(db *DB, draft chirpDraft) (Chirp, error) {
+	chirp := Chirp{}
+	err := db.update(func(dbStructure *DBStructure) error {
+		inReplyTo := 0
+		if draft.InReplyTo != 0 {
+			parent, found := shareTarget(*dbStructure, draft.InReplyTo)
+			if !found || !canViewChirp(*dbStructure, chirpViewer{ID: draft.AuthorID}, parent, readDirect) {
+				return errParentNotFound
+			}
+			inReplyTo = parent.ID
+		}
+		quoted := Chirp{}
+		if draft.QuotedChirpID != 0 {
+			found := false
+			quoted, found = shareTarget(*dbStructure, draft.QuotedChirpID)
+			if !found || !canViewChirp(*dbStructure, chirpViewer{ID: draft.AuthorID}, quoted, readDirect) {
+				return errQuotedChirpNotFound
+			}
+		}
+
+		var err error
+		chirp, err = db.CreateChirp(draft.Body, draft.AuthorID, inReplyTo)
+		if err != nil {
+			return err
+		}
+		chirp.Mentions = resolveMentions(*dbStructure, draft.AuthorID, draft.Body)
+		chirp.QuotedChirpID = quoted.ID
+		chirp.MediaIDs = draft.MediaIDs
+		chirp.Visibility = draft.Visibility
+		err = dbStructure.attachMedia(chirp)
+		if err != nil {
+			return err
+		}
+		dbStructure.Chirps[chirp.ID] = chirp
+		dbStructure.LastChirpID = chirp.ID
+		dbStructure.addToTimeline(chirp)
+		dbStructure.addReply(chirp)
+		dbStructure.addShare(chirp)
+		dbStructure.indexHashtags(chirp)
+		dbStructure.notifyChirp(chirp, mentionedUsers(chirp.Mentions), true)
+		if quoted.ID != 0 {
+			dbStructure.notify(quoted.AuthorID, Notification{Type: notificationQuote, ActorID: draft.AuthorID, ChirpID: chirp.ID})
+		}
+		return nil
+	})
 	if err != nil {
 		return Chirp{}, err
 	}
@@ -119,16 +183,6 @@ func saveUserToDB(db *DB, email, password string) (User, error) {
 	if err != nil {
 		return User{}, err
 	}
-	dbStructure, err := db.LoadDB()
-	if err != nil {
-		return User{}, err
-	}
-
-	dbStructure.Users[user.ID] = user
-	err = db.WriteDB(dbStructure)
-	if err != nil {
-		return User{}, err
-	}
 
 	return user, nil
 
@@ -158,12 +212,28 @@ func findUser(db *DB, email string) (User, error) {
 
 }
 
+// chirpyClaims are the claims carried by access tokens. Scope and ClientID
+// are only set on tokens issued to third-party OAuth clients.
+type chirpyClaims struct {
+	Scope    string `json:"scope,omitempty"`
+	ClientID string `json:"client_id,omitempty"`
+	jwt.RegisteredClaims
+}
+
 func createJWT(secretKey string, userId int) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-		Issuer:    "chirpy",
-		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
-		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour).UTC()),
-		Subject:   strconv.Itoa(userId),
+	return createScopedJWT(secretKey, userId, "", nil)
+}
+
+func createScopedJWT(secretKey string, userId int, clientID string, scopes []string) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, chirpyClaims{
+		Scope:    strings.Join(scopes, " "),
+		ClientID: clientID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    "chirpy",
+			IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(accessTokenLifetime).UTC()),
+			Subject:   strconv.Itoa(userId),
+		},
 	})
 	s, err := token.SignedString([]byte(secretKey))
 
@@ -174,26 +244,47 @@ func createJWT(secretKey string, userId int) (string, error) {
 	return s, nil
 }
 
+// validateToken only accepts first-party session tokens; tokens issued to
+// OAuth clients must go through validateScopedToken.
 func validateToken(jwtToken string) (int, error) {
-	token, err := jwt.ParseWithClaims(jwtToken, &jwt.RegisteredClaims{},
+	id, scopes, err := validateScopedToken(jwtToken)
+	if err != nil {
+		return 0, err
+	}
+	if scopes != nil {
+		return 0, errors.New("token was issued to a third-party client")
+	}
+
+	return id, nil
+}
+
+// validateScopedToken returns the user id and, for tokens issued to OAuth
+// clients, the granted scopes. Session tokens return nil scopes.
+func validateScopedToken(jwtToken string) (int, []string, error) {
+	claims := &chirpyClaims{}
+	token, err := jwt.ParseWithClaims(jwtToken, claims,
 		func(token *jwt.Token) (interface{}, error) {
 			return []byte(os.Getenv("JWT_SECRET")), nil
 		})
 	if err != nil {
-		return 0, err
+		return 0, nil, err
 	}
 
 	id, err := token.Claims.GetSubject()
 	if err != nil {
-		return 0, errors.New("error getting user id")
+		return 0, nil, errors.New("error getting user id")
 	}
 
 	numberId, err := strconv.Atoi(id)
 	if err != nil {
-		return 0, errors.New("error converting id to integer")
+		return 0, nil, errors.New("error converting id to integer")
 	}
 
-	return numberId, nil
+	if claims.ClientID == "" {
+		return numberId, nil, nil
+	}
+
+	return numberId, strings.Fields(claims.Scope), nil
 }
 
 func updateUserInDB(db *DB, id int, email, password string) (User, error) {
@@ -212,26 +303,21 @@ func generateRefreshToken() string {
 }
 
 func saveRefreshToken(db *DB, userId int) (string, error) {
-	dbStructure, err := db.LoadDB()
-	if err != nil {
-		return "", err
-	}
-
-	user, found := dbStructure.Users[userId]
-	if !found {
-		return "", errors.New("user not found")
-	}
-
 	token := generateRefreshToken()
-	refreshToken := RefreshToken{
-		Token:      token,
-		CreatedAt:  time.Now().UTC(),
-		DaysActive: 60,
-	}
-	user.RefreshToken = refreshToken
-	dbStructure.Users[userId] = user
+	err := db.update(func(dbStructure *DBStructure) error {
+		user, found := dbStructure.Users[userId]
+		if !found {
+			return errors.New("user not found")
+		}
 
-	err = db.WriteDB(dbStructure)
+		user.RefreshToken = RefreshToken{
+			Token:      token,
+			CreatedAt:  time.Now().UTC(),
+			DaysActive: 60,
+		}
+		dbStructure.Users[userId] = user
+		return nil
+	})
 	if err != nil {
 		return "", err
 	}
@@ -253,62 +339,67 @@ func validateRefreshToken(db *DB, refreshToken string) (bool, int) {
 }
 
 func deleteRefreshTokenFromDB(db *DB, refreshToken string) error {
-	dbStructure, err := db.LoadDB()
-	if err != nil {
-		return err
-	}
-
-	for userId := range dbStructure.Users {
-		if refreshToken == dbStructure.Users[userId].RefreshToken.Token {
-			user := dbStructure.Users[userId]
-			user.RefreshToken = RefreshToken{}
-			dbStructure.Users[userId] = user
-			db.WriteDB(dbStructure)
-			return nil
+	return db.update(func(dbStructure *DBStructure) error {
+		for userId := range dbStructure.Users {
+			if refreshToken == dbStructure.Users[userId].RefreshToken.Token {
+				user := dbStructure.Users[userId]
+				user.RefreshToken = RefreshToken{}
+				dbStructure.Users[userId] = user
+				return nil
+			}
 		}
-	}
-
-	return nil
+		return nil
+	})
 }
 
 func deleteChirpFromDB(db *DB, chirpID int) error {
-	dbStructure, err := db.LoadDB()
-	if err != nil {
-		return err
-	}
-	_, found := dbStructure.Chirps[chirpID]
-	if !found {
-		return errors.New("chirp does not exist")
-	}
-
-	delete(dbStructure.Chirps, chirpID)
-
-	err = db.WriteDB(dbStructure)
-	if err != nil {
-		return err
-	}
+	return db.update(func(dbStructure *DBStructure) error {
+		_, found := dbStructure.Chirps[chirpID]
+		if !found {
+			return errors.New("chirp does not exist")
+		}
 
-	return nil
+		dbStructure.removeChirp(chirpID)
+		return nil
+	})
 }
 
 func upgradeUserInDB(db *DB, userID int) error {
-	dbStructure, err := db.LoadDB()
-	if err != nil {
-		return err
-	}
+	return db.update(func(dbStructure *DBStructure) error {
+		user, found := dbStructure.Users[userID]
+		if !found {
+			return errors.New("user not found")
+		}
 
-	user, found := dbStructure.Users[userID]
-	if !found {
-		return errors.New("user not found")
-	}
+		user.IsChirpyRed = true
+		recordSubscriptionEvent(&user, "polka")
+		dbStructure.Users[userID] = user
+		return nil
+	})
+}
 
-	user.IsChirpyRed = true
-	dbStructure.Users[userID] = user
+func envString(name, fallback string) string {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	return value
+}
 
-	err = db.WriteDB(dbStructure)
+func envInt(name string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
 	if err != nil {
-		return err
+		return fallback
 	}
+	return value
+}
 
-	return nil
+// envPositiveInt is envInt for settings that only make sense above zero, such
+// as intervals; anything else falls back.
+func envPositiveInt(name string, fallback int) int {
+	value := envInt(name, fallback)
+	if value <= 0 {
+		return fallback
+	}
+	return value
 }
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"log"
+	"sort"
+)
+
+// Thumbnail is a scaled down copy of an uploaded image.
+type Thumbnail struct {
+	Size        string `json:"size"`
+	BlobKey     string `json:"blob_key"`
+	ContentType string `json:"content_type"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	ByteSize    int64  `json:"byte_size"`
+}
+
+const (
+	mediaStatusProcessing = "processing"
+	mediaStatusReady      = "ready"
+	mediaStatusFailed     = "failed"
+
+	jpegQuality = 90
+	// blurhashes are computed from a copy this small; they only describe a
+	// handful of colour gradients anyway
+	blurhashSourceSide = 32
+)
+
+// thumbnails are scaled to fit within a MaxSide square; sizes the image
+// already fits in are skipped
+var thumbnailSizes = []struct {
+	Name    string
+	MaxSide int
+}{
+	{"small", 150},
+	{"medium", 600},
+	{"large", 1200},
+}
+
+var (
+	errInvalidImage  = errors.New("could not decode image")
+	errImageTooLarge = errors.New("image dimensions are too large")
+)
+
+/*
+stripImage decodes an uploaded image and encodes it again, which drops
+everything but the pixels: EXIF (including GPS coordinates), XMP, comments and
+colour profiles. JPEG orientation is applied to the pixels first so photos
+still come out the right way up. Returns the new file and its dimensions.
+*/
+func stripImage(data []byte, contentType string, maxPixels int) ([]byte, int, int, error) {
+	imageConfig, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, 0, 0, errInvalidImage
+	}
+	pixels := imageConfig.Width * imageConfig.Height
+	if contentType == "image/gif" {
+		// every frame of an animation is decoded, so count them all
+		pixels, err = gifPixels(data)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+	}
+	if pixels > maxPixels {
+		return nil, 0, 0, errImageTooLarge
+	}
+
+	buf := &bytes.Buffer{}
+	switch contentType {
+	case "image/jpeg":
+		img, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, 0, 0, errInvalidImage
+		}
+		img = orientImage(img, jpegOrientation(data))
+		err = jpeg.Encode(buf, img, &jpeg.Options{Quality: jpegQuality})
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		return buf.Bytes(), img.Bounds().Dx(), img.Bounds().Dy(), nil
+	case "image/png":
+		img, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, 0, 0, errInvalidImage
+		}
+		err = png.Encode(buf, img)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		return buf.Bytes(), img.Bounds().Dx(), img.Bounds().Dy(), nil
+	case "image/gif":
+		animation, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			return nil, 0, 0, errInvalidImage
+		}
+		err = gif.EncodeAll(buf, animation)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		return buf.Bytes(), animation.Config.Width, animation.Config.Height, nil
+	default:
+		return nil, 0, 0, errUnsupportedMedia
+	}
+}
+
+/*
+gifPixels adds up the size of every frame in a GIF without decoding any of
+them. Frames compress extremely well, so a small file can otherwise expand to
+gigabytes.
+*/
+func gifPixels(data []byte) (int, error) {
+	if len(data) < 13 {
+		return 0, errInvalidImage
+	}
+	pos := 13
+	if data[10]&0x80 != 0 {
+		pos += 3 << (data[10]&0x07 + 1)
+	}
+
+	skipSubBlocks := func() bool {
+		for pos < len(data) {
+			size := int(data[pos])
+			pos += size + 1
+			if size == 0 {
+				return true
+			}
+		}
+		return false
+	}
+
+	pixels := 0
+	for pos < len(data) {
+		switch data[pos] {
+		case 0x21:
+			pos += 2
+			if !skipSubBlocks() {
+				return 0, errInvalidImage
+			}
+		case 0x2C:
+			if pos+10 > len(data) {
+				return 0, errInvalidImage
+			}
+			width := int(binary.LittleEndian.Uint16(data[pos+5:]))
+			height := int(binary.LittleEndian.Uint16(data[pos+7:]))
+			pixels += width * height
+			if data[pos+9]&0x80 != 0 {
+				pos += 3 << (data[pos+9]&0x07 + 1)
+			}
+			// descriptor and LZW minimum code size
+			pos += 11
+			if !skipSubBlocks() {
+				return 0, errInvalidImage
+			}
+		case 0x3B:
+			return pixels, nil
+		default:
+			return 0, errInvalidImage
+		}
+	}
+	return pixels, nil
+}
+
+// jpegOrientation reads the EXIF orientation tag of a JPEG, 1 (as stored) if
+// there is none.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	pos := 2
+	for pos+4 <= len(data) && data[pos] == 0xFF {
+		marker := data[pos+1]
+		// start of scan: no more metadata after this
+		if marker == 0xDA || marker == 0xD9 {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			break
+		}
+		segment := data[pos+4 : end]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		pos = end
+	}
+	return 1
+}
+
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			orientation := int(order.Uint16(tiff[entry+8:]))
+			if orientation < 1 || orientation > 8 {
+				return 1
+			}
+			return orientation
+		}
+	}
+	return 1
+}
+
+// orientImage applies an EXIF orientation, so the result is meant to be shown
+// as is.
+func orientImage(src image.Image, orientation int) image.Image {
+	if orientation == 1 {
+		return src
+	}
+
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	dstWidth, dstHeight := width, height
+	// 5 to 8 turn the image on its side
+	if orientation >= 5 {
+		dstWidth, dstHeight = height, width
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	for y := 0; y < dstHeight; y++ {
+		for x := 0; x < dstWidth; x++ {
+			sx, sy := x, y
+			switch orientation {
+			case 2:
+				sx = width - 1 - x
+			case 3:
+				sx, sy = width-1-x, height-1-y
+			case 4:
+				sy = height - 1 - y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, height-1-x
+			case 7:
+				sx, sy = width-1-y, height-1-x
+			case 8:
+				sx, sy = width-1-y, x
+			}
+			dst.Set(x, y, src.At(bounds.Min.X+sx, bounds.Min.Y+sy))
+		}
+	}
+	return dst
+}
+
+// fitWithin scales width and height down to fit in a maxSide square, keeping
+// the aspect ratio.
+func fitWithin(width, height, maxSide int) (int, int) {
+	if width <= maxSide && height <= maxSide {
+		return width, height
+	}
+	if width >= height {
+		return maxSide, max(1, height*maxSide/width)
+	}
+	return max(1, width*maxSide/height), maxSide
+}
+
+// resizeImage scales src down by averaging the source pixels that fall into
+// each destination pixel.
+func resizeImage(src image.Image, width, height int) *image.RGBA {
+	bounds := src.Bounds()
+	rgba, ok := src.(*image.RGBA)
+	if !ok || bounds.Min != (image.Point{}) {
+		rgba = image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		draw.Draw(rgba, rgba.Bounds(), src, bounds.Min, draw.Src)
+	}
+	srcWidth, srcHeight := rgba.Bounds().Dx(), rgba.Bounds().Dy()
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := y * srcHeight / height
+		y1 := max(y0+1, (y+1)*srcHeight/height)
+		for x := 0; x < width; x++ {
+			x0 := x * srcWidth / width
+			x1 := max(x0+1, (x+1)*srcWidth/width)
+
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				row := rgba.Pix[sy*rgba.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					for c := 0; c < 4; c++ {
+						sum[c] += int(row[sx*4+c])
+					}
+				}
+			}
+			count := (y1 - y0) * (x1 - x0)
+			out := dst.Pix[y*dst.Stride+x*4:]
+			for c := 0; c < 4; c++ {
+				out[c] = uint8(sum[c] / count)
+			}
+		}
+	}
+	return dst
+}
+
+// makeThumbnails stores a scaled copy of img for each thumbnail size it's
+// bigger than. Thumbnails of JPEGs are JPEGs; everything else becomes a PNG
+// so transparency survives.
+func makeThumbnails(blobs BlobStore, img image.Image, contentType string) ([]Thumbnail, error) {
+	thumbnails := []Thumbnail{}
+	bounds := img.Bounds()
+	for _, size := range thumbnailSizes {
+		if bounds.Dx() <= size.MaxSide && bounds.Dy() <= size.MaxSide {
+			continue
+		}
+		width, height := fitWithin(bounds.Dx(), bounds.Dy(), size.MaxSide)
+		thumbnail := resizeImage(img, width, height)
+
+		buf := &bytes.Buffer{}
+		thumbnailType := "image/png"
+		var err error
+		if contentType == "image/jpeg" {
+			thumbnailType = "image/jpeg"
+			err = jpeg.Encode(buf, thumbnail, &jpeg.Options{Quality: jpegQuality})
+		} else {
+			err = png.Encode(buf, thumbnail)
+		}
+		if err != nil {
+			return thumbnails, err
+		}
+
+		key, byteSize, err := blobs.Put(buf)
+		if err != nil {
+			return thumbnails, err
+		}
+		thumbnails = append(thumbnails, Thumbnail{
+			Size:        size.Name,
+			BlobKey:     key,
+			ContentType: thumbnailType,
+			Width:       width,
+			Height:      height,
+			ByteSize:    byteSize,
+		})
+	}
+	return thumbnails, nil
+}
+
+func finishMediaProcessing(db *DB, mediaID string, thumbnails []Thumbnail, blurhash string, processErr error) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		media, found := dbStructure.Media[mediaID]
+		if !found {
+			// removed while we were working on it; the sweeper takes care
+			// of whatever was already stored
+			for _, thumbnail := range thumbnails {
+				dbStructure.PendingBlobDeletes = append(dbStructure.PendingBlobDeletes, thumbnail.BlobKey)
+			}
+			return nil
+		}
+
+		media.Thumbnails = thumbnails
+		media.Blurhash = blurhash
+		media.Status = mediaStatusReady
+		if processErr != nil {
+			media.Status = mediaStatusFailed
+		}
+		dbStructure.Media[mediaID] = media
+		return nil
+	})
+}
+
+// processMedia makes the thumbnails and blurhash of an uploaded image. The
+// upload itself was already stripped when it was stored.
+func (config *apiConfig) processMedia(mediaID string) {
+	dbStructure, err := config.db.LoadDB()
+	if err != nil {
+		log.Printf("media %s could not be processed: %v", mediaID, err)
+		return
+	}
+	media, found := dbStructure.Media[mediaID]
+	if !found || media.Status != mediaStatusProcessing {
+		return
+	}
+
+	thumbnails := []Thumbnail{}
+	blurhash := ""
+	processErr := func() error {
+		blob, err := config.blobs.Open(media.BlobKey)
+		if err != nil {
+			return err
+		}
+		defer blob.Close()
+
+		// the first frame stands in for an animated GIF
+		img, _, err := image.Decode(blob)
+		if err != nil {
+			return err
+		}
+		thumbnails, err = makeThumbnails(config.blobs, img, media.ContentType)
+		if err != nil {
+			return err
+		}
+
+		bounds := img.Bounds()
+		width, height := fitWithin(bounds.Dx(), bounds.Dy(), blurhashSourceSide)
+		blurhash = encodeBlurhash(resizeImage(img, width, height), 4, 3)
+		return nil
+	}()
+	if processErr != nil {
+		log.Printf("media %s could not be processed: %v", mediaID, processErr)
+	}
+
+	err = finishMediaProcessing(config.db, mediaID, thumbnails, blurhash, processErr)
+	if err != nil {
+		log.Printf("media %s could not be saved: %v", mediaID, err)
+	}
+}
+
+func (config *apiConfig) runMediaWorker() {
+	for mediaID := range config.mediaQueue {
+		config.processMedia(mediaID)
+	}
+}
+
+// queueMedia hands an upload to the media worker without waiting for it.
+func (config *apiConfig) queueMedia(mediaID string) {
+	go func() {
+		config.mediaQueue <- mediaID
+	}()
+}
+
+// resumeMediaProcessing queues uploads that were still being processed when
+// the server last stopped, oldest first.
+func (config *apiConfig) resumeMediaProcessing() {
+	dbStructure, err := config.db.LoadDB()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	pending := []Media{}
+	for _, media := range dbStructure.Media {
+		if media.Status == mediaStatusProcessing {
+			pending = append(pending, media)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].CreatedAt.Before(pending[j].CreatedAt) })
+
+	go func() {
+		for _, media := range pending {
+			config.mediaQueue <- media.ID
+		}
+	}()
+}
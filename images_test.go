@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"testing"
+)
+
+// encodeGIF builds a GIF with one frame of each of the given sizes.
+func encodeGIF(t *testing.T, sizes ...image.Point) []byte {
+	t.Helper()
+	palette := color.Palette{color.Black, color.White}
+	animation := &gif.GIF{}
+	for _, size := range sizes {
+		animation.Image = append(animation.Image, image.NewPaletted(image.Rect(0, 0, size.X, size.Y), palette))
+		animation.Delay = append(animation.Delay, 0)
+	}
+	buf := bytes.Buffer{}
+	err := gif.EncodeAll(&buf, animation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestGIFPixels(t *testing.T) {
+	oneFrame := encodeGIF(t, image.Pt(4, 3))
+	threeFrames := encodeGIF(t, image.Pt(10, 10), image.Pt(10, 10), image.Pt(5, 2))
+
+	tests := []struct {
+		name    string
+		data    []byte
+		want    int
+		wantErr bool
+	}{
+		{"single frame", oneFrame, 12, false},
+		{"every frame counts", threeFrames, 210, false},
+		{"missing trailer", threeFrames[:len(threeFrames)-1], 210, false},
+		{"too short for a header", oneFrame[:12], 0, true},
+		{"truncated frame", threeFrames[:len(threeFrames)/2], 0, true},
+		{"unknown block", append(append([]byte{}, oneFrame[:len(oneFrame)-1]...), 0x00), 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := gifPixels(tt.data)
+			if tt.wantErr {
+				if !errors.Is(err, errInvalidImage) {
+					t.Errorf("gifPixels() error = %v, want %v", err, errInvalidImage)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("gifPixels() = %d, %v, want %d", got, err, tt.want)
+			}
+		})
+	}
+}
+
+// exifSegment builds an APP1 segment holding an EXIF block with one IFD entry
+// for the orientation tag.
+func exifSegment(order binary.ByteOrder, orientation uint16) []byte {
+	tiff := make([]byte, 8+2+12)
+	if order == binary.LittleEndian {
+		copy(tiff, "II")
+	} else {
+		copy(tiff, "MM")
+	}
+	order.PutUint16(tiff[2:], 42)
+	order.PutUint32(tiff[4:], 8)
+	order.PutUint16(tiff[8:], 1)
+	order.PutUint16(tiff[10:], 0x0112)
+	// SHORT, one value
+	order.PutUint16(tiff[12:], 3)
+	order.PutUint32(tiff[14:], 1)
+	order.PutUint16(tiff[18:], orientation)
+
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	segment := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+// withSegment inserts a segment straight after a JPEG's start of image marker.
+func withSegment(jpegData, segment []byte) []byte {
+	data := append([]byte{}, jpegData[:2]...)
+	data = append(data, segment...)
+	return append(data, jpegData[2:]...)
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	buf := bytes.Buffer{}
+	err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 2, 2)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := buf.Bytes()
+
+	tests := []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{"no exif", plain, 1},
+		{"little endian", withSegment(plain, exifSegment(binary.LittleEndian, 6)), 6},
+		{"big endian", withSegment(plain, exifSegment(binary.BigEndian, 8)), 8},
+		{"out of range", withSegment(plain, exifSegment(binary.LittleEndian, 9)), 1},
+		{"truncated segment", withSegment(plain, exifSegment(binary.LittleEndian, 6))[:20], 1},
+		{"not a jpeg", []byte("GIF89a"), 1},
+		{"empty", nil, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := jpegOrientation(tt.data)
+			if got != tt.want {
+				t.Errorf("jpegOrientation() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
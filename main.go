@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -15,15 +16,80 @@ func main() {
 		log.Fatal("Error loading .env file")
 	}
 
+	if len(os.Args) > 1 {
+		err = runCommand(os.Args[1:])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	err = runServer()
 	if err != nil {
 		fmt.Println(err)
 	}
 }
 
+func openDB() (*DB, error) {
+	hasher, err := passwordHasherFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return NewDB("database.json", hasher)
+}
+
+/*
+runCommand handles one-off maintenance commands:
+
+	promote-admin <email>   make the first admin
+*/
+func runCommand(args []string) error {
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "promote-admin":
+		if len(args) != 2 {
+			return errors.New("usage: promote-admin <email>")
+		}
+		err = promoteFirstAdmin(db, args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s is now an admin\n", args[1])
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
 func runServer() error {
 	serveMux := http.NewServeMux()
-	db, err := NewDB("database.json")
+	db, err := openDB()
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	policy, err := passwordPolicyFromEnv()
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	deletion, err := deletionPolicyFromEnv()
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	media := mediaSettingsFromEnv()
+	blobs, err := newLocalBlobStore(media.Dir)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	messages, err := NewMessageDB("messages.json")
 	if err != nil {
 		log.Println(err)
 		return err
@@ -33,8 +99,24 @@ func runServer() error {
 		db:             db,
 		jwtSecret:      os.Getenv("JWT_SECRET"),
 		polkaKey:       os.Getenv("POLKA_KEY"),
+		passwordPolicy: policy,
+		deletionPolicy: deletion,
+		exportSettings: exportSettingsFromEnv(),
+		search:         newSearchIndex(),
+		editWindows:    editWindowsFromEnv(),
+		timelines:      newTimelineCache(envPositiveInt("HOME_TIMELINE_CACHE_SIZE", 800)),
+		media:          media,
+		blobs:          blobs,
+		mediaQueue:     make(chan string, 64),
+		messages:       messages,
 	}
+	config.rebuildSearchIndex()
 	registerHandlers(serveMux, config)
+	go config.runDeletionSweeper()
+	config.resumeExportJobs()
+	go config.runMediaSweeper()
+	go config.runMediaWorker()
+	config.resumeMediaProcessing()
 
 	server := &http.Server{
 		Addr:    "localhost:8080",
@@ -53,16 +135,85 @@ func runServer() error {
 func registerHandlers(serveMux *http.ServeMux, config *apiConfig) {
 	serveMux.Handle("GET /app/*", config.middlewareMetricsInc(fileServerHandler()))
 	serveMux.HandleFunc("GET /api/healthz", readinessHandler)
-	serveMux.HandleFunc("GET /admin/metrics", config.showMetricsHandler)
-	serveMux.HandleFunc("GET /api/reset", config.resetMetricsHandler)
+	serveMux.HandleFunc("GET /admin/metrics", config.middlewareRequirePermission(permAccessAdmin, config.showMetricsHandler))
+	serveMux.HandleFunc("GET /api/reset", config.middlewareRequirePermission(permAccessAdmin, config.resetMetricsHandler))
 	serveMux.HandleFunc("POST /api/chirps", config.saveChirpsHandler)
 	serveMux.HandleFunc("GET /api/chirps", config.getChirpsHandler)
 	serveMux.HandleFunc("GET /api/chirps/{chirpID}", config.getChirpByIdHandler)
+	serveMux.HandleFunc("GET /api/chirps/search", config.searchChirpsHandler)
 	serveMux.HandleFunc("POST /api/users", config.saveUserHandler)
 	serveMux.HandleFunc("POST /api/login", config.loginUsersHandler)
 	serveMux.HandleFunc("PUT /api/users", config.updateUsersHandler)
 	serveMux.HandleFunc("POST /api/refresh", config.refreshTokenHandler)
 	serveMux.HandleFunc("POST /api/revoke", config.revokeRefreshHandler)
 	serveMux.HandleFunc("DELETE /api/chirps/{chirpID}", config.deleteChirpHandler)
+	serveMux.HandleFunc("PUT /api/chirps/{chirpID}", config.editChirpHandler)
+	serveMux.HandleFunc("GET /api/chirps/{chirpID}/revisions", config.getChirpRevisionsHandler)
+	serveMux.HandleFunc("GET /api/chirps/{chirpID}/thread", config.getThreadHandler)
+	serveMux.HandleFunc("GET /api/chirps/{chirpID}/reactions", config.getReactionsHandler)
+	serveMux.HandleFunc("PUT /api/chirps/{chirpID}/reactions/{emoji}", config.reactionHandler)
+	serveMux.HandleFunc("DELETE /api/chirps/{chirpID}/reactions/{emoji}", config.reactionHandler)
+	serveMux.HandleFunc("PUT /api/users/{userID}/follow", config.followHandler)
+	serveMux.HandleFunc("DELETE /api/users/{userID}/follow", config.followHandler)
+	serveMux.HandleFunc("GET /api/users/{userID}/followers", config.followListHandler)
+	serveMux.HandleFunc("GET /api/users/{userID}/following", config.followListHandler)
+	serveMux.HandleFunc("PUT /api/users/{userID}/block", config.restrictionHandler)
+	serveMux.HandleFunc("DELETE /api/users/{userID}/block", config.restrictionHandler)
+	serveMux.HandleFunc("PUT /api/users/{userID}/mute", config.restrictionHandler)
+	serveMux.HandleFunc("DELETE /api/users/{userID}/mute", config.restrictionHandler)
+	serveMux.HandleFunc("GET /api/users/me/blocks", config.restrictionListHandler)
+	serveMux.HandleFunc("GET /api/users/me/mutes", config.restrictionListHandler)
+	serveMux.HandleFunc("PUT /api/chirps/{chirpID}/bookmark", config.bookmarkHandler)
+	serveMux.HandleFunc("DELETE /api/chirps/{chirpID}/bookmark", config.bookmarkHandler)
+	serveMux.HandleFunc("GET /api/users/me/bookmarks", config.getBookmarksHandler)
+	serveMux.HandleFunc("POST /api/users/me/collections", config.createCollectionHandler)
+	serveMux.HandleFunc("GET /api/users/me/collections", config.getCollectionsHandler)
+	serveMux.HandleFunc("PUT /api/users/me/collections/{collectionID}", config.renameCollectionHandler)
+	serveMux.HandleFunc("DELETE /api/users/me/collections/{collectionID}", config.deleteCollectionHandler)
+	serveMux.HandleFunc("GET /api/timeline/home", config.homeTimelineHandler)
+	serveMux.HandleFunc("GET /api/hashtags/{tag}/chirps", config.hashtagChirpsHandler)
+	serveMux.HandleFunc("GET /api/trending", config.trendingHandler)
+	serveMux.HandleFunc("PUT /api/users/me/handle", config.setHandleHandler)
+	serveMux.HandleFunc("PUT /api/users/me/profile", config.updateProfileHandler)
+	serveMux.HandleFunc("GET /api/users/{handle}", config.getProfileHandler)
+	serveMux.HandleFunc("POST /api/chirps/{chirpID}/rechirp", config.rechirpHandler)
+	serveMux.HandleFunc("DELETE /api/chirps/{chirpID}/rechirp", config.undoRechirpHandler)
+	serveMux.HandleFunc("POST /api/media", config.uploadMediaHandler)
+	serveMux.HandleFunc("GET /api/media/{mediaID}", config.getMediaHandler)
+	serveMux.HandleFunc("POST /api/conversations", config.startConversationHandler)
+	serveMux.HandleFunc("GET /api/conversations", config.getConversationsHandler)
+	serveMux.HandleFunc("GET /api/conversations/{conversationID}", config.getConversationHandler)
+	serveMux.HandleFunc("GET /api/conversations/{conversationID}/messages", config.getMessagesHandler)
+	serveMux.HandleFunc("POST /api/conversations/{conversationID}/messages", config.sendMessageHandler)
+	serveMux.HandleFunc("POST /api/conversations/{conversationID}/read", config.markConversationReadHandler)
+	serveMux.HandleFunc("PUT /api/conversations/{conversationID}/mute", config.muteConversationHandler)
+	serveMux.HandleFunc("DELETE /api/conversations/{conversationID}/mute", config.muteConversationHandler)
+	serveMux.HandleFunc("GET /api/notifications", config.getNotificationsHandler)
+	serveMux.HandleFunc("POST /api/notifications/read", config.markNotificationsReadHandler)
+	serveMux.HandleFunc("POST /api/notifications/{notificationID}/read", config.markNotificationsReadHandler)
 	serveMux.HandleFunc("POST /api/polka/webhooks", config.webhookHandler)
+	serveMux.HandleFunc("POST /api/tokens", config.createAccessTokenHandler)
+	serveMux.HandleFunc("GET /api/tokens", config.getAccessTokensHandler)
+	serveMux.HandleFunc("DELETE /api/tokens/{tokenID}", config.deleteAccessTokenHandler)
+	serveMux.HandleFunc("POST /api/oauth/clients", config.registerOAuthClientHandler)
+	serveMux.HandleFunc("GET /oauth/authorize", config.authorizeHandler)
+	serveMux.HandleFunc("POST /oauth/authorize", config.authorizeConsentHandler)
+	serveMux.HandleFunc("POST /oauth/token", config.tokenHandler)
+	serveMux.HandleFunc("POST /oauth/revoke", config.revokeOAuthTokenHandler)
+	serveMux.HandleFunc("PUT /api/chirps/{chirpID}/hidden", config.middlewareRequirePermission(permHideChirps, config.hideChirpHandler))
+	serveMux.HandleFunc("DELETE /api/chirps/{chirpID}/hidden", config.middlewareRequirePermission(permHideChirps, config.hideChirpHandler))
+	serveMux.HandleFunc("PUT /admin/api/users/{userID}/role", config.middlewareRequirePermission(permManageUsers, config.setUserRoleHandler))
+	serveMux.HandleFunc("GET /admin/api/users", config.middlewareRequirePermission(permManageUsers, config.adminListUsersHandler))
+	serveMux.HandleFunc("GET /admin/api/users/{userID}", config.middlewareRequirePermission(permManageUsers, config.adminGetUserHandler))
+	serveMux.HandleFunc("PUT /admin/api/users/{userID}/suspension", config.middlewareRequirePermission(permManageUsers, config.adminSuspendUserHandler))
+	serveMux.HandleFunc("DELETE /admin/api/users/{userID}/suspension", config.middlewareRequirePermission(permManageUsers, config.adminSuspendUserHandler))
+	serveMux.HandleFunc("POST /admin/api/users/{userID}/password-reset", config.middlewareRequirePermission(permManageUsers, config.adminForcePasswordResetHandler))
+	serveMux.HandleFunc("PUT /admin/api/users/{userID}/chirpy-red", config.middlewareRequirePermission(permManageUsers, config.adminSetChirpyRedHandler))
+	serveMux.HandleFunc("GET /admin/api/audit", config.middlewareRequirePermission(permManageUsers, config.adminAuditLogHandler))
+	serveMux.HandleFunc("POST /api/users/password-reset", config.completePasswordResetHandler)
+	serveMux.HandleFunc("DELETE /api/users", config.deleteUserHandler)
+	serveMux.HandleFunc("POST /api/users/deletion/cancel", config.cancelUserDeletionHandler)
+	serveMux.HandleFunc("POST /api/users/me/export", config.startExportHandler)
+	serveMux.HandleFunc("GET /api/users/me/export/{jobID}", config.getExportHandler)
+	serveMux.HandleFunc("GET /api/exports/{jobID}/download", config.downloadExportHandler)
 }
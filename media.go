@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Media is an uploaded file. It belongs to its uploader until it's attached
+// to one of their chirps or made their avatar, and goes away with that chirp
+// or when the avatar is replaced.
+type Media struct {
+	ID          string    `json:"id"`
+	OwnerID     int       `json:"owner_id"`
+	BlobKey     string    `json:"blob_key"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	ChirpID     int       `json:"chirp_id,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	Width       int       `json:"width"`
+	Height      int       `json:"height"`
+	// thumbnails and the blurhash are made in the background; Status says
+	// whether that has happened yet
+	Status     string      `json:"status"`
+	Thumbnails []Thumbnail `json:"thumbnails,omitempty"`
+	Blurhash   string      `json:"blurhash,omitempty"`
+	// set while the media is its owner's avatar
+	Avatar bool `json:"avatar,omitempty"`
+}
+
+type mediaSettings struct {
+	Dir      string
+	MaxBytes int64
+	// width times height, summed over the frames of a GIF
+	MaxPixels int
+	// uploads never attached to a chirp are removed after this long
+	OrphanLifetime time.Duration
+	SweepInterval  time.Duration
+}
+
+type mediaResponse struct {
+	ID          string              `json:"id"`
+	ContentType string              `json:"content_type"`
+	Size        int64               `json:"size"`
+	URL         string              `json:"url"`
+	Width       int                 `json:"width"`
+	Height      int                 `json:"height"`
+	Status      string              `json:"status"`
+	Blurhash    string              `json:"blurhash,omitempty"`
+	Thumbnails  []thumbnailResponse `json:"thumbnails,omitempty"`
+}
+
+type thumbnailResponse struct {
+	Size   string `json:"size"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	URL    string `json:"url"`
+}
+
+const maxMediaPerChirp = 4
+
+// how long a blob has to sit unused after it was last stored before the
+// sweeper deletes it; comfortably longer than an upload takes to be recorded
+const blobGracePeriod = 15 * time.Minute
+
+// checked against the sniffed type, never the file name or the type the
+// client claims. Only types we can decode are allowed, since every upload is
+// re-encoded to strip its metadata.
+var allowedMediaTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+}
+
+var (
+	errMediaTooLarge     = errors.New("file is too large")
+	errTooManyMedia      = errors.New("a chirp can have at most " + strconv.Itoa(maxMediaPerChirp) + " media attachments")
+	errInvalidMedia      = errors.New("media_ids must refer to your own uploads that aren't attached to a chirp yet")
+	errUnsupportedMedia  = errors.New("unsupported media type")
+	errMissingMediaField = errors.New("expected a multipart/form-data body with a file field")
+)
+
+func mediaSettingsFromEnv() mediaSettings {
+	return mediaSettings{
+		Dir:            envString("MEDIA_DIR", "media"),
+		MaxBytes:       int64(envInt("MEDIA_MAX_BYTES", 5<<20)),
+		MaxPixels:      envInt("MEDIA_MAX_PIXELS", 25_000_000),
+		OrphanLifetime: time.Duration(envInt("MEDIA_ORPHAN_HOURS", 24)) * time.Hour,
+		SweepInterval:  time.Duration(envPositiveInt("MEDIA_SWEEP_SECONDS", 300)) * time.Second,
+	}
+}
+
+func newMediaResponse(media Media) mediaResponse {
+	response := mediaResponse{
+		ID:          media.ID,
+		ContentType: media.ContentType,
+		Size:        media.Size,
+		URL:         "/api/media/" + media.ID,
+		Width:       media.Width,
+		Height:      media.Height,
+		Status:      media.Status,
+		Blurhash:    media.Blurhash,
+	}
+	for _, thumbnail := range media.Thumbnails {
+		response.Thumbnails = append(response.Thumbnails, thumbnailResponse{
+			Size:   thumbnail.Size,
+			Width:  thumbnail.Width,
+			Height: thumbnail.Height,
+			URL:    response.URL + "?size=" + thumbnail.Size,
+		})
+	}
+	return response
+}
+
+func attachMediaResponses(dbStructure DBStructure, chirps []Chirp) {
+	for i := range chirps {
+		for _, mediaID := range chirps[i].MediaIDs {
+			media, found := dbStructure.Media[mediaID]
+			if found {
+				chirps[i].Media = append(chirps[i].Media, newMediaResponse(media))
+			}
+		}
+	}
+}
+
+// sizeLimitReader fails with errMediaTooLarge once more than limit bytes have
+// been read, so an oversized upload never makes it into the blob store.
+type sizeLimitReader struct {
+	r     io.Reader
+	limit int64
+	read  int64
+}
+
+func (reader *sizeLimitReader) Read(p []byte) (int, error) {
+	n, err := reader.r.Read(p)
+	reader.read += int64(n)
+	if reader.read > reader.limit {
+		return n, errMediaTooLarge
+	}
+	return n, err
+}
+
+// attachMedia checks that mediaIDs can go on the chirp and attaches them.
+func (dbStructure *DBStructure) attachMedia(chirp Chirp) error {
+	if len(chirp.MediaIDs) > maxMediaPerChirp {
+		return errTooManyMedia
+	}
+	for i, mediaID := range chirp.MediaIDs {
+		media, found := dbStructure.Media[mediaID]
+		if !found || media.OwnerID != chirp.AuthorID || media.ChirpID != 0 || media.Avatar {
+			return errInvalidMedia
+		}
+		for _, otherID := range chirp.MediaIDs[:i] {
+			if otherID == mediaID {
+				return errInvalidMedia
+			}
+		}
+	}
+
+	for _, mediaID := range chirp.MediaIDs {
+		media := dbStructure.Media[mediaID]
+		media.ChirpID = chirp.ID
+		dbStructure.Media[mediaID] = media
+	}
+	return nil
+}
+
+// removeMedia deletes a media record. Its blob is only queued for deletion;
+// the media sweeper removes it once nothing else uses the same content.
+func (dbStructure *DBStructure) removeMedia(mediaID string) {
+	media, found := dbStructure.Media[mediaID]
+	if !found {
+		return
+	}
+	delete(dbStructure.Media, mediaID)
+	dbStructure.PendingBlobDeletes = append(dbStructure.PendingBlobDeletes, media.BlobKey)
+	for _, thumbnail := range media.Thumbnails {
+		dbStructure.PendingBlobDeletes = append(dbStructure.PendingBlobDeletes, thumbnail.BlobKey)
+	}
+}
+
+// removeUserMedia removes a purged user's uploads, except those on chirps that
+// are being kept anonymously.
+func (dbStructure *DBStructure) removeUserMedia(userID int) {
+	for mediaID, media := range dbStructure.Media {
+		if media.OwnerID != userID {
+			continue
+		}
+		if _, found := dbStructure.Chirps[media.ChirpID]; found && media.ChirpID != 0 {
+			media.OwnerID = 0
+			dbStructure.Media[mediaID] = media
+			continue
+		}
+		dbStructure.removeMedia(mediaID)
+	}
+}
+
+func saveMedia(db *DB, media Media) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		dbStructure.Media[media.ID] = media
+		return nil
+	})
+}
+
+/*
+sweepMedia removes uploads that were never attached to a chirp and then the
+blobs no media record refers to anymore. Blobs are deleted while the database
+is locked, so nothing can start referring to one between the check and the
+delete. Blobs stored again within blobGracePeriod may be about to be recorded
+by an upload in flight, so they wait for a later sweep.
+*/
+func sweepMedia(db *DB, blobs BlobStore, orphanLifetime time.Duration, now time.Time) (int, error) {
+	deleted := 0
+	err := db.update(func(dbStructure *DBStructure) error {
+		for mediaID, media := range dbStructure.Media {
+			if media.ChirpID == 0 && !media.Avatar && now.Sub(media.CreatedAt) > orphanLifetime {
+				dbStructure.removeMedia(mediaID)
+			}
+		}
+		if len(dbStructure.PendingBlobDeletes) == 0 {
+			return errNothingToPurge
+		}
+
+		inUse := make(map[string]bool)
+		for _, media := range dbStructure.Media {
+			inUse[media.BlobKey] = true
+			for _, thumbnail := range media.Thumbnails {
+				inUse[thumbnail.BlobKey] = true
+			}
+		}
+		pending := []string{}
+		for _, key := range dbStructure.PendingBlobDeletes {
+			if inUse[key] {
+				continue
+			}
+			inUse[key] = true
+
+			removed, err := blobs.Delete(key, now.Add(-blobGracePeriod))
+			if err != nil {
+				log.Printf("could not delete blob %s: %v", key, err)
+			}
+			if !removed {
+				pending = append(pending, key)
+				continue
+			}
+			deleted++
+		}
+		dbStructure.PendingBlobDeletes = pending
+		return nil
+	})
+	if errors.Is(err, errNothingToPurge) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
+
+func (config *apiConfig) runMediaSweeper() {
+	ticker := time.NewTicker(config.media.SweepInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		_, err := sweepMedia(config.db, config.blobs, config.media.OrphanLifetime, time.Now().UTC())
+		if err != nil {
+			log.Printf("media sweep failed: %v", err)
+		}
+	}
+}
+
+/*
+route: /api/media
+method: POST
+
+	req body: multipart/form-data with the file in a field named "file"
+
+	req headers: {
+		Authorization string (jwtToken or access token with chirps:write)
+	}
+
+Responds with the media id to pass in media_ids when posting a chirp. The image
+is stored re-encoded without its metadata; thumbnails and the blurhash follow
+shortly after, once status is "ready".
+*/
+func (config *apiConfig) uploadMediaHandler(w http.ResponseWriter, req *http.Request) {
+	id, err := config.authenticate(req, scopeChirpsWrite)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	// leave some room for the multipart framing around the file
+	req.Body = http.MaxBytesReader(w, req.Body, config.media.MaxBytes+64<<10)
+	reader, err := req.MultipartReader()
+	if err != nil {
+		respondWithError(w, 400, errMissingMediaField.Error())
+		return
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			respondWithError(w, 400, errMissingMediaField.Error())
+			return
+		}
+		if part.FormName() != "file" {
+			continue
+		}
+
+		head := make([]byte, 512)
+		n, err := io.ReadFull(part, head)
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+			respondWithUploadError(w, err)
+			return
+		}
+		contentType := http.DetectContentType(head[:n])
+		if !allowedMediaTypes[contentType] {
+			respondWithError(w, 415, errUnsupportedMedia.Error())
+			return
+		}
+
+		// the original is only ever held in memory, so its metadata never
+		// reaches the blob store
+		data, err := io.ReadAll(&sizeLimitReader{r: io.MultiReader(bytes.NewReader(head[:n]), part), limit: config.media.MaxBytes})
+		if err != nil {
+			respondWithUploadError(w, err)
+			return
+		}
+		stripped, width, height, err := stripImage(data, contentType, config.media.MaxPixels)
+		if err != nil {
+			respondWithUploadError(w, err)
+			return
+		}
+		key, size, err := config.blobs.Put(bytes.NewReader(stripped))
+		if err != nil {
+			respondWithUploadError(w, err)
+			return
+		}
+
+		media := Media{
+			ID:          generateRefreshToken()[:32],
+			OwnerID:     id,
+			BlobKey:     key,
+			ContentType: contentType,
+			Size:        size,
+			CreatedAt:   time.Now().UTC(),
+			Width:       width,
+			Height:      height,
+			Status:      mediaStatusProcessing,
+		}
+		err = saveMedia(config.db, media)
+		if err != nil {
+			respondWithError(w, 500, err.Error())
+			return
+		}
+		config.queueMedia(media.ID)
+
+		respondWithJSON(w, 201, newMediaResponse(media))
+		return
+	}
+}
+
+func respondWithUploadError(w http.ResponseWriter, err error) {
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.Is(err, errMediaTooLarge) || errors.As(err, &maxBytesErr):
+		respondWithError(w, 413, errMediaTooLarge.Error())
+		return
+	case errors.Is(err, errImageTooLarge):
+		respondWithError(w, 413, err.Error())
+		return
+	case errors.Is(err, errInvalidImage):
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	respondWithError(w, 500, err.Error())
+}
+
+/*
+route: /api/media/{mediaID}?size={small, medium or large, optional}
+method: GET
+
+Without size the full image is served. Sizes the image is already smaller than,
+or that haven't been made yet, are 404s; the media response lists the ones
+that exist.
+
+Access is checked on every request, so caches have to revalidate; the ETag
+makes that a 304 while the viewer can still see the media. Only media on
+public chirps and avatars may be kept by shared caches.
+*/
+func (config *apiConfig) getMediaHandler(w http.ResponseWriter, req *http.Request) {
+	dbStructure, err := config.db.LoadDB()
+	if err != nil {
+		respondWithError(w, 500, err.Error())
+		return
+	}
+
+	media, found := dbStructure.Media[req.PathValue("mediaID")]
+	if !found {
+		respondWithError(w, 404, "media not found")
+		return
+	}
+	cacheControl := "private, no-cache"
+	if media.Avatar {
+		cacheControl = "public, no-cache"
+	}
+	if media.ChirpID != 0 {
+		chirp, found := dbStructure.Chirps[media.ChirpID]
+		if !found || chirp.Hidden || !canViewChirp(dbStructure, config.optionalViewer(req), chirp, readDirect) {
+			respondWithError(w, 404, "media not found")
+			return
+		}
+		if chirp.Visibility == visibilityPublic {
+			cacheControl = "public, no-cache"
+		}
+	}
+
+	blobKey, contentType, size := media.BlobKey, media.ContentType, media.Size
+	if sizeName := req.URL.Query().Get("size"); sizeName != "" {
+		found := false
+		for _, thumbnail := range media.Thumbnails {
+			if thumbnail.Size == sizeName {
+				blobKey, contentType, size = thumbnail.BlobKey, thumbnail.ContentType, thumbnail.ByteSize
+				found = true
+			}
+		}
+		if !found {
+			respondWithError(w, 404, "thumbnail not found")
+			return
+		}
+	}
+
+	// content addressed, so the key is the version
+	etag := `"` + blobKey + `"`
+	w.Header().Set("Cache-Control", cacheControl)
+	w.Header().Set("ETag", etag)
+	if req.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(304)
+		return
+	}
+
+	blob, err := config.blobs.Open(blobKey)
+	if err != nil {
+		if errors.Is(err, errBlobNotFound) {
+			respondWithError(w, 404, "media not found")
+			return
+		}
+		respondWithError(w, 500, err.Error())
+		return
+	}
+	defer blob.Close()
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(200)
+	io.Copy(w, blob)
+}
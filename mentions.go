@@ -0,0 +1,67 @@
+package main
+
+import "unicode/utf8"
+
+// Mention is an @handle in a chirp body that resolved to a user. Start and
+// End are offsets in characters (code points) into the body, End exclusive.
+type Mention struct {
+	UserID int    `json:"user_id"`
+	Handle string `json:"handle"`
+	Start  int    `json:"start"`
+	End    int    `json:"end"`
+}
+
+func isHandleByte(b byte) bool {
+	return b == '_' || ('a' <= b && b <= 'z') || ('A' <= b && b <= 'Z') || ('0' <= b && b <= '9')
+}
+
+/*
+resolveMentions finds the @handles in body that belong to a user. An @ only
+starts a mention at the beginning of a word, so email addresses don't count,
+and handles that don't exist, or whose user is blocked from or by the author,
+are left as plain text.
+*/
+func resolveMentions(dbStructure DBStructure, authorID int, body string) []Mention {
+	mentions := []Mention{}
+	for i := 0; i < len(body); i++ {
+		if body[i] != '@' || (i > 0 && isHandleByte(body[i-1])) {
+			continue
+		}
+
+		end := i + 1
+		for end < len(body) && isHandleByte(body[end]) {
+			end++
+		}
+		handle := body[i+1 : end]
+		if !handlePattern.MatchString(handle) {
+			continue
+		}
+		user, found := findUserByHandle(dbStructure, handle)
+		if !found || dbStructure.isBlocked(authorID, user.ID) {
+			continue
+		}
+
+		start := utf8.RuneCountInString(body[:i])
+		mentions = append(mentions, Mention{
+			UserID: user.ID,
+			Handle: user.Handle,
+			Start:  start,
+			End:    start + utf8.RuneCountInString(body[i:end]),
+		})
+		i = end - 1
+	}
+	return mentions
+}
+
+// mentionedUsers returns the distinct users mentioned, in order.
+func mentionedUsers(mentions []Mention) []int {
+	userIDs := []int{}
+	seen := make(map[int]bool)
+	for _, mention := range mentions {
+		if !seen[mention.UserID] {
+			seen[mention.UserID] = true
+			userIDs = append(userIDs, mention.UserID)
+		}
+	}
+	return userIDs
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+/*
+MessageDB holds direct messages. They're kept in their own file, apart from
+the chirps database, so nothing that reads chirps can ever reach them; the
+only way in is through the conversation handlers, which check membership.
+*/
+type MessageDB struct {
+	path string
+	mux  *sync.Mutex
+}
+
+type MessageStructure struct {
+	Conversations map[int]Conversation `json:"conversations"`
+	// messages by conversation id, oldest first
+	Messages           map[int][]Message `json:"messages"`
+	LastConversationID int               `json:"last_conversation_id"`
+	LastMessageID      int               `json:"last_message_id"`
+}
+
+type Conversation struct {
+	ID      int                  `json:"id"`
+	Members []ConversationMember `json:"members"`
+	// set when the conversation is started and whenever a message is sent
+	UpdatedAt time.Time `json:"updated_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type ConversationMember struct {
+	UserID int `json:"user_id"`
+	// id of the newest message the member has read, 0 for none
+	LastReadMessageID int  `json:"last_read_message_id"`
+	Muted             bool `json:"muted"`
+}
+
+type Message struct {
+	ID             int       `json:"id"`
+	ConversationID int       `json:"conversation_id"`
+	SenderID       int       `json:"sender_id"`
+	Body           string    `json:"body"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+func NewMessageDB(path string) (*MessageDB, error) {
+	db := MessageDB{
+		path: path,
+		mux:  &sync.Mutex{},
+	}
+	_, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		err = os.WriteFile(path, nil, 0666)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &db, nil
+}
+
+func (db *MessageDB) Load() (MessageStructure, error) {
+	fileContent, err := os.ReadFile(db.path)
+	if err != nil {
+		return MessageStructure{}, err
+	}
+	messageStructure := MessageStructure{
+		Conversations: make(map[int]Conversation),
+		Messages:      make(map[int][]Message),
+	}
+	if len(fileContent) == 0 {
+		return messageStructure, nil
+	}
+	err = json.Unmarshal(fileContent, &messageStructure)
+	if err != nil {
+		return MessageStructure{}, err
+	}
+	return messageStructure, nil
+}
+
+// update is DB.update for messages.
+func (db *MessageDB) update(fn func(messageStructure *MessageStructure) error) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	messageStructure, err := db.Load()
+	if err != nil {
+		return err
+	}
+
+	err = fn(&messageStructure)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(messageStructure)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(db.path, data)
+}
+
+func (conversation Conversation) member(userID int) (ConversationMember, bool) {
+	index := slices.IndexFunc(conversation.Members, func(member ConversationMember) bool {
+		return member.UserID == userID
+	})
+	if index == -1 {
+		return ConversationMember{}, false
+	}
+	return conversation.Members[index], true
+}
+
+// unreadCount is how many messages from others userID hasn't read yet.
+func (messageStructure MessageStructure) unreadCount(conversationID, userID int) int {
+	conversation := messageStructure.Conversations[conversationID]
+	member, _ := conversation.member(userID)
+	count := 0
+	for _, message := range messageStructure.Messages[conversationID] {
+		if message.ID > member.LastReadMessageID && message.SenderID != userID {
+			count++
+		}
+	}
+	return count
+}
+
+/*
+removeUsers takes purged users out of their conversations along with the
+messages they sent. Conversations nobody is left in are dropped. It runs after
+the accounts are purged from the main database and is safe to repeat.
+*/
+func (db *MessageDB) removeUsers(userIDs []int) error {
+	return db.update(func(messageStructure *MessageStructure) error {
+		for id, conversation := range messageStructure.Conversations {
+			conversation.Members = slices.DeleteFunc(conversation.Members, func(member ConversationMember) bool {
+				return slices.Contains(userIDs, member.UserID)
+			})
+			if len(conversation.Members) == 0 {
+				delete(messageStructure.Conversations, id)
+				delete(messageStructure.Messages, id)
+				continue
+			}
+			messageStructure.Conversations[id] = conversation
+			messageStructure.Messages[id] = slices.DeleteFunc(messageStructure.Messages[id], func(message Message) bool {
+				return slices.Contains(userIDs, message.SenderID)
+			})
+		}
+		return nil
+	})
+}
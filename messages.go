@@ -0,0 +1,636 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// a conversation holds at most this many users, counting whoever started it
+const maxConversationMembers = 10
+
+var (
+	errConversationNotFound = errors.New("conversation not found")
+	errNoRecipients         = errors.New("user_ids must name at least one other user")
+	errTooManyMembers       = errors.New("a conversation can have at most 10 members")
+	errMessageBlocked       = errors.New("you can't message this conversation")
+	errEmptyMessage         = errors.New("message body is required")
+	errMessageTooLong       = errors.New("message is too long")
+)
+
+type conversationMemberResponse struct {
+	chirpAuthor
+	LastReadMessageID int `json:"last_read_message_id"`
+}
+
+type conversationResponse struct {
+	ID          int                          `json:"id"`
+	Members     []conversationMemberResponse `json:"members"`
+	LastMessage *Message                     `json:"last_message"`
+	UnreadCount int                          `json:"unread_count"`
+	Muted       bool                         `json:"muted"`
+	CreatedAt   time.Time                    `json:"created_at"`
+	UpdatedAt   time.Time                    `json:"updated_at"`
+}
+
+func conversationKey(conversation Conversation) pageCursor {
+	return pageCursor{CreatedAt: conversation.UpdatedAt, ID: conversation.ID}
+}
+
+func messageKey(message Message) pageCursor {
+	return pageCursor{CreatedAt: message.CreatedAt, ID: message.ID}
+}
+
+// conversationResponse renders the conversation for viewerID, who must be a
+// member. Members' read positions are the read receipts.
+func (messageStructure MessageStructure) conversationResponse(dbStructure DBStructure, conversation Conversation, viewerID int) conversationResponse {
+	viewer, _ := conversation.member(viewerID)
+	response := conversationResponse{
+		ID:          conversation.ID,
+		Members:     []conversationMemberResponse{},
+		UnreadCount: messageStructure.unreadCount(conversation.ID, viewerID),
+		Muted:       viewer.Muted,
+		CreatedAt:   conversation.CreatedAt,
+		UpdatedAt:   conversation.UpdatedAt,
+	}
+	for _, member := range conversation.Members {
+		author := chirpAuthor{ID: member.UserID}
+		if user, found := dbStructure.Users[member.UserID]; found {
+			author = newChirpAuthor(dbStructure, user)
+		}
+		response.Members = append(response.Members, conversationMemberResponse{
+			chirpAuthor:       author,
+			LastReadMessageID: member.LastReadMessageID,
+		})
+	}
+	if messages := messageStructure.Messages[conversation.ID]; len(messages) > 0 {
+		response.LastMessage = &messages[len(messages)-1]
+	}
+	return response
+}
+
+// checkRecipients makes sure senderID may message every other user in
+// userIDs: each has to exist, and none can have blocked the sender or been
+// blocked by them.
+func checkRecipients(dbStructure DBStructure, senderID int, userIDs []int) error {
+	for _, userID := range userIDs {
+		if userID == senderID {
+			continue
+		}
+		if _, found := dbStructure.Users[userID]; !found {
+			return errors.New("user not found")
+		}
+		if dbStructure.isBlocked(senderID, userID) {
+			return errMessageBlocked
+		}
+	}
+	return nil
+}
+
+// checkMembers makes sure userIDs can all be put in one conversation: the
+// sender checks for each of them, and no two of them blocking each other
+// either, so nobody gets put in front of someone they blocked.
+func checkMembers(dbStructure DBStructure, userIDs []int) error {
+	for i, userID := range userIDs {
+		err := checkRecipients(dbStructure, userID, userIDs[i+1:])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// memberIDs is the ids of everyone in the conversation.
+func (conversation Conversation) memberIDs() []int {
+	ids := make([]int, 0, len(conversation.Members))
+	for _, member := range conversation.Members {
+		ids = append(ids, member.UserID)
+	}
+	return ids
+}
+
+/*
+startConversation starts a conversation between creatorID and userIDs. For two
+people there's only ever one conversation, so asking again returns the
+existing one and created is false.
+*/
+func startConversation(db *MessageDB, dbStructure DBStructure, creatorID int, userIDs []int) (Conversation, bool, error) {
+	memberIDs := []int{creatorID}
+	for _, userID := range userIDs {
+		if !slices.Contains(memberIDs, userID) {
+			memberIDs = append(memberIDs, userID)
+		}
+	}
+	if len(memberIDs) < 2 {
+		return Conversation{}, false, errNoRecipients
+	}
+	if len(memberIDs) > maxConversationMembers {
+		return Conversation{}, false, errTooManyMembers
+	}
+	err := checkMembers(dbStructure, memberIDs)
+	if err != nil {
+		return Conversation{}, false, err
+	}
+
+	conversation := Conversation{}
+	created := false
+	err = db.update(func(messageStructure *MessageStructure) error {
+		if len(memberIDs) == 2 {
+			for _, existing := range messageStructure.Conversations {
+				ids := existing.memberIDs()
+				if len(ids) == 2 && slices.Contains(ids, memberIDs[0]) && slices.Contains(ids, memberIDs[1]) {
+					conversation = existing
+					return nil
+				}
+			}
+		}
+
+		now := time.Now().UTC()
+		messageStructure.LastConversationID++
+		conversation = Conversation{
+			ID:        messageStructure.LastConversationID,
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+		for _, userID := range memberIDs {
+			conversation.Members = append(conversation.Members, ConversationMember{UserID: userID})
+		}
+		messageStructure.Conversations[conversation.ID] = conversation
+		created = true
+		return nil
+	})
+	if err != nil {
+		return Conversation{}, false, err
+	}
+	return conversation, created, nil
+}
+
+/*
+sendMessage posts body to the conversation. Sending counts as reading
+everything up to the new message.
+*/
+func sendMessage(db *MessageDB, dbStructure DBStructure, conversationID, senderID int, body string) (Message, error) {
+	message := Message{}
+	err := db.update(func(messageStructure *MessageStructure) error {
+		conversation, found := messageStructure.Conversations[conversationID]
+		if !found {
+			return errConversationNotFound
+		}
+		if _, isMember := conversation.member(senderID); !isMember {
+			return errConversationNotFound
+		}
+		err := checkRecipients(dbStructure, senderID, conversation.memberIDs())
+		if err != nil {
+			return err
+		}
+
+		messageStructure.LastMessageID++
+		message = Message{
+			ID:             messageStructure.LastMessageID,
+			ConversationID: conversationID,
+			SenderID:       senderID,
+			Body:           body,
+			CreatedAt:      time.Now().UTC(),
+		}
+		messageStructure.Messages[conversationID] = append(messageStructure.Messages[conversationID], message)
+
+		conversation.UpdatedAt = message.CreatedAt
+		for i := range conversation.Members {
+			if conversation.Members[i].UserID == senderID {
+				conversation.Members[i].LastReadMessageID = message.ID
+			}
+		}
+		messageStructure.Conversations[conversationID] = conversation
+		return nil
+	})
+	if err != nil {
+		return Message{}, err
+	}
+	return message, nil
+}
+
+// updateMember applies fn to userID's membership of the conversation.
+func updateMember(db *MessageDB, conversationID, userID int, fn func(messageStructure MessageStructure, member *ConversationMember)) error {
+	return db.update(func(messageStructure *MessageStructure) error {
+		conversation, found := messageStructure.Conversations[conversationID]
+		if !found {
+			return errConversationNotFound
+		}
+		index := slices.IndexFunc(conversation.Members, func(member ConversationMember) bool {
+			return member.UserID == userID
+		})
+		if index == -1 {
+			return errConversationNotFound
+		}
+		fn(*messageStructure, &conversation.Members[index])
+		messageStructure.Conversations[conversationID] = conversation
+		return nil
+	})
+}
+
+func pathConversationID(w http.ResponseWriter, req *http.Request) (int, bool) {
+	conversationID, err := strconv.Atoi(req.PathValue("conversationID"))
+	if err != nil {
+		respondWithError(w, 400, "invalid conversation id")
+		return 0, false
+	}
+	return conversationID, true
+}
+
+func respondWithMessageError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errNoRecipients) || errors.Is(err, errTooManyMembers) ||
+		errors.Is(err, errEmptyMessage) || errors.Is(err, errMessageTooLong):
+		respondWithError(w, 400, err.Error())
+	case errors.Is(err, errMessageBlocked):
+		respondWithError(w, 403, err.Error())
+	case errors.Is(err, errConversationNotFound) || err.Error() == "user not found":
+		respondWithError(w, 404, err.Error())
+	default:
+		respondWithError(w, 500, err.Error())
+	}
+}
+
+/*
+route: /api/conversations
+method: POST
+
+Starts a conversation with the given users, or returns the existing one when
+there's just one other user (200 instead of 201). Nobody in it can have
+blocked anyone else in it.
+
+	req body shape: {
+		user_ids []int
+	}
+
+	req headers: {
+		Authorization string (jwtToken or access token with messages:write)
+	}
+*/
+func (config *apiConfig) startConversationHandler(w http.ResponseWriter, req *http.Request) {
+	id, err := config.authenticate(req, scopeMessagesWrite)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	params, err := decodeJSON(req)
+	if err != nil {
+		respondWithError(w, 500, "error decoding request body")
+		return
+	}
+
+	dbStructure, err := config.db.LoadDB()
+	if err != nil {
+		respondWithError(w, 500, err.Error())
+		return
+	}
+
+	conversation, created, err := startConversation(config.messages, dbStructure, id, params.UserIDs)
+	if err != nil {
+		respondWithMessageError(w, err)
+		return
+	}
+
+	messageStructure, err := config.messages.Load()
+	if err != nil {
+		respondWithError(w, 500, err.Error())
+		return
+	}
+	status := 200
+	if created {
+		status = 201
+	}
+	respondWithJSON(w, status, messageStructure.conversationResponse(dbStructure, conversation, id))
+}
+
+type conversationPage struct {
+	Conversations []conversationResponse `json:"conversations"`
+	Count         int                    `json:"count"`
+	// unread messages across the conversations you haven't muted
+	UnreadCount int    `json:"unread_count"`
+	NextCursor  string `json:"next_cursor,omitempty"`
+	PrevCursor  string `json:"prev_cursor,omitempty"`
+}
+
+/*
+route: /api/conversations?limit={optional}&cursor={optional}
+method: GET
+
+Your conversations, most recently active first.
+
+	req headers: {
+		Authorization string (jwtToken or access token with messages:read)
+	}
+*/
+func (config *apiConfig) getConversationsHandler(w http.ResponseWriter, req *http.Request) {
+	id, err := config.authenticate(req, scopeMessagesRead)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	limit, cursor, err := pageRequest(req, "conversations")
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+
+	dbStructure, err := config.db.LoadDB()
+	if err != nil {
+		respondWithError(w, 500, err.Error())
+		return
+	}
+	messageStructure, err := config.messages.Load()
+	if err != nil {
+		respondWithError(w, 500, err.Error())
+		return
+	}
+
+	conversations := []Conversation{}
+	unread := 0
+	for _, conversation := range messageStructure.Conversations {
+		member, isMember := conversation.member(id)
+		if !isMember {
+			continue
+		}
+		conversations = append(conversations, conversation)
+		if !member.Muted {
+			unread += messageStructure.unreadCount(conversation.ID, id)
+		}
+	}
+	sort.Slice(conversations, func(i, j int) bool {
+		return byTimeDesc(conversationKey(conversations[i]), conversationKey(conversations[j]))
+	})
+
+	page, next, prev := paginate(conversations, conversationKey, byTimeDesc, limit, cursor)
+	nextCursor, prevCursor := pageLinks(w, req, "conversations", next, prev)
+
+	responses := make([]conversationResponse, 0, len(page))
+	for _, conversation := range page {
+		responses = append(responses, messageStructure.conversationResponse(dbStructure, conversation, id))
+	}
+
+	respondWithJSON(w, 200, conversationPage{
+		Conversations: responses,
+		Count:         len(conversations),
+		UnreadCount:   unread,
+		NextCursor:    nextCursor,
+		PrevCursor:    prevCursor,
+	})
+}
+
+/*
+route: /api/conversations/{conversationID}
+method: GET
+
+	req headers: {
+		Authorization string (jwtToken or access token with messages:read)
+	}
+*/
+func (config *apiConfig) getConversationHandler(w http.ResponseWriter, req *http.Request) {
+	id, err := config.authenticate(req, scopeMessagesRead)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	conversationID, ok := pathConversationID(w, req)
+	if !ok {
+		return
+	}
+
+	dbStructure, err := config.db.LoadDB()
+	if err != nil {
+		respondWithError(w, 500, err.Error())
+		return
+	}
+	messageStructure, err := config.messages.Load()
+	if err != nil {
+		respondWithError(w, 500, err.Error())
+		return
+	}
+
+	conversation, found := messageStructure.Conversations[conversationID]
+	if _, isMember := conversation.member(id); !found || !isMember {
+		respondWithError(w, 404, errConversationNotFound.Error())
+		return
+	}
+
+	respondWithJSON(w, 200, messageStructure.conversationResponse(dbStructure, conversation, id))
+}
+
+type messagePage struct {
+	Messages   []Message `json:"messages"`
+	Count      int       `json:"count"`
+	NextCursor string    `json:"next_cursor,omitempty"`
+	PrevCursor string    `json:"prev_cursor,omitempty"`
+}
+
+/*
+route: /api/conversations/{conversationID}/messages?limit={optional}&cursor={optional}
+method: GET
+
+The conversation's messages, newest first. Reading them doesn't mark them
+read; use POST /api/conversations/{conversationID}/read.
+
+	req headers: {
+		Authorization string (jwtToken or access token with messages:read)
+	}
+*/
+func (config *apiConfig) getMessagesHandler(w http.ResponseWriter, req *http.Request) {
+	id, err := config.authenticate(req, scopeMessagesRead)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	conversationID, ok := pathConversationID(w, req)
+	if !ok {
+		return
+	}
+
+	limit, cursor, err := pageRequest(req, "messages")
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+
+	messageStructure, err := config.messages.Load()
+	if err != nil {
+		respondWithError(w, 500, err.Error())
+		return
+	}
+
+	conversation, found := messageStructure.Conversations[conversationID]
+	if _, isMember := conversation.member(id); !found || !isMember {
+		respondWithError(w, 404, errConversationNotFound.Error())
+		return
+	}
+
+	messages := slices.Clone(messageStructure.Messages[conversationID])
+	slices.Reverse(messages)
+
+	page, next, prev := paginate(messages, messageKey, byTimeDesc, limit, cursor)
+	nextCursor, prevCursor := pageLinks(w, req, "messages", next, prev)
+	if page == nil {
+		page = []Message{}
+	}
+
+	respondWithJSON(w, 200, messagePage{
+		Messages:   page,
+		Count:      len(messages),
+		NextCursor: nextCursor,
+		PrevCursor: prevCursor,
+	})
+}
+
+/*
+route: /api/conversations/{conversationID}/messages
+method: POST
+
+Bodies get the same length limit and word filter as chirps.
+
+	req body shape: {
+		body string
+	}
+
+	req headers: {
+		Authorization string (jwtToken or access token with messages:write)
+	}
+*/
+func (config *apiConfig) sendMessageHandler(w http.ResponseWriter, req *http.Request) {
+	id, err := config.authenticate(req, scopeMessagesWrite)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	conversationID, ok := pathConversationID(w, req)
+	if !ok {
+		return
+	}
+
+	params, err := decodeJSON(req)
+	if err != nil {
+		respondWithError(w, 500, "error decoding request body")
+		return
+	}
+
+	switch {
+	case strings.TrimSpace(params.Body) == "":
+		respondWithMessageError(w, errEmptyMessage)
+		return
+	case !validateChirp(params.Body):
+		respondWithMessageError(w, errMessageTooLong)
+		return
+	}
+
+	dbStructure, err := config.db.LoadDB()
+	if err != nil {
+		respondWithError(w, 500, err.Error())
+		return
+	}
+
+	message, err := sendMessage(config.messages, dbStructure, conversationID, id, cleanMessage(params.Body))
+	if err != nil {
+		respondWithMessageError(w, err)
+		return
+	}
+
+	respondWithJSON(w, 201, message)
+}
+
+/*
+route: /api/conversations/{conversationID}/read
+method: POST
+
+Marks the conversation read up to message_id, or up to its newest message
+when message_id is left out. The read position only ever moves forward.
+
+	req body shape: {
+		message_id int
+	}
+
+	req headers: {
+		Authorization string (jwtToken or access token with messages:write)
+	}
+*/
+func (config *apiConfig) markConversationReadHandler(w http.ResponseWriter, req *http.Request) {
+	id, err := config.authenticate(req, scopeMessagesWrite)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	conversationID, ok := pathConversationID(w, req)
+	if !ok {
+		return
+	}
+
+	params := parameters{}
+	if req.ContentLength != 0 {
+		params, err = decodeJSON(req)
+		if err != nil {
+			respondWithError(w, 500, "error decoding request body")
+			return
+		}
+	}
+
+	err = updateMember(config.messages, conversationID, id, func(messageStructure MessageStructure, member *ConversationMember) {
+		messages := messageStructure.Messages[conversationID]
+		if len(messages) == 0 {
+			return
+		}
+		readTo := messages[len(messages)-1].ID
+		if params.MessageID != 0 {
+			readTo = min(params.MessageID, readTo)
+		}
+		member.LastReadMessageID = max(member.LastReadMessageID, readTo)
+	})
+	if err != nil {
+		respondWithMessageError(w, err)
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+/*
+route: /api/conversations/{conversationID}/mute
+method: PUT | DELETE
+
+A muted conversation still gets messages, but they don't count towards the
+unread total in GET /api/conversations.
+
+	req headers: {
+		Authorization string (jwtToken or access token with messages:write)
+	}
+*/
+func (config *apiConfig) muteConversationHandler(w http.ResponseWriter, req *http.Request) {
+	id, err := config.authenticate(req, scopeMessagesWrite)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	conversationID, ok := pathConversationID(w, req)
+	if !ok {
+		return
+	}
+
+	muted := req.Method == http.MethodPut
+	err = updateMember(config.messages, conversationID, id, func(messageStructure MessageStructure, member *ConversationMember) {
+		member.Muted = muted
+	})
+	if err != nil {
+		respondWithMessageError(w, err)
+		return
+	}
+
+	w.WriteHeader(204)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func messagingFixture() DBStructure {
+	return DBStructure{
+		Users: map[int]User{1: {ID: 1}, 2: {ID: 2}, 3: {ID: 3}, 4: {ID: 4}},
+		// 2 blocked 3
+		Blocks: map[int][]Restriction{2: {{UserID: 3}}},
+	}
+}
+
+func TestCheckRecipients(t *testing.T) {
+	dbStructure := messagingFixture()
+	tests := []struct {
+		name     string
+		senderID int
+		userIDs  []int
+		// "" for no error
+		wantErr string
+	}{
+		{"no recipients", 1, nil, ""},
+		{"unrelated users", 1, []int{2, 3}, ""},
+		{"sender among recipients", 1, []int{1, 2}, ""},
+		{"recipient blocked sender", 3, []int{2}, errMessageBlocked.Error()},
+		{"sender blocked recipient", 2, []int{1, 3}, errMessageBlocked.Error()},
+		{"unknown recipient", 1, []int{2, 9}, "user not found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkRecipients(dbStructure, tt.senderID, tt.userIDs)
+			got := ""
+			if err != nil {
+				got = err.Error()
+			}
+			if got != tt.wantErr {
+				t.Errorf("checkRecipients(%d, %v) = %q, want %q", tt.senderID, tt.userIDs, got, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckMembers(t *testing.T) {
+	dbStructure := messagingFixture()
+	tests := []struct {
+		name    string
+		userIDs []int
+		wantErr error
+	}{
+		{"two unrelated users", []int{1, 2}, nil},
+		{"group without blocks", []int{1, 2, 4}, nil},
+		{"creator blocked", []int{3, 2}, errMessageBlocked},
+		// neither 2 nor 3 started it, but they still can't share a conversation
+		{"members block each other", []int{1, 2, 3}, errMessageBlocked},
+		{"members block each other in reverse order", []int{4, 3, 1, 2}, errMessageBlocked},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkMembers(dbStructure, tt.userIDs)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("checkMembers(%v) = %v, want %v", tt.userIDs, err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"net/http"
+	"strings"
 )
 
 func (config *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
@@ -10,3 +12,33 @@ func (config *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
 		next.ServeHTTP(w, req)
 	})
 }
+
+/*
+middlewareRequirePermission only lets a request through when it carries a
+session JWT for a user whose role grants permission. The user id is stored on
+the request context for the wrapped handler.
+*/
+func (config *apiConfig) middlewareRequirePermission(permission string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		jwtToken := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		id, err := validateToken(jwtToken)
+		if err != nil {
+			respondWithError(w, 401, err.Error())
+			return
+		}
+
+		user, err := config.activeUser(id)
+		if err != nil {
+			respondWithAuthError(w, err)
+			return
+		}
+
+		if !hasPermission(user, permission) {
+			respondWithError(w, 403, "you do not have permission to do this")
+			return
+		}
+
+		ctx := context.WithValue(req.Context(), userIDContextKey, id)
+		next.ServeHTTP(w, req.WithContext(ctx))
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+)
+
+type Notification struct {
+	ID      int    `json:"id"`
+	Type    string `json:"type"`
+	ActorID int    `json:"actor_id"`
+	ChirpID int    `json:"chirp_id,omitempty"`
+	// set on reaction notifications
+	Emoji     string     `json:"emoji,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ReadAt    *time.Time `json:"read_at"`
+}
+
+const (
+	notificationMention  = "mention"
+	notificationReply    = "reply"
+	notificationReaction = "reaction"
+	notificationFollow   = "follow"
+	notificationRechirp  = "rechirp"
+	notificationQuote    = "quote"
+)
+
+// only the newest notifications of each user are kept
+const maxNotificationsPerUser = 1000
+
+var errNotificationNotFound = errors.New("notification not found")
+
+func notificationKey(notification Notification) pageCursor {
+	return pageCursor{CreatedAt: notification.CreatedAt, ID: notification.ID}
+}
+
+// notify records a notification for userID. It has to run inside the same
+// update as the action it reports. Users aren't notified of their own actions,
+// of those of users they blocked, muted or were blocked by, or about chirps
+// they can't see.
+func (dbStructure *DBStructure) notify(userID int, notification Notification) {
+	if userID == notification.ActorID || userID == 0 {
+		return
+	}
+	if _, found := dbStructure.Users[userID]; !found {
+		return
+	}
+	if dbStructure.isBlocked(userID, notification.ActorID) || dbStructure.isMuting(userID, notification.ActorID) {
+		return
+	}
+	if chirp, found := dbStructure.Chirps[notification.ChirpID]; found && !canViewChirp(*dbStructure, chirpViewer{ID: userID}, chirp, readDirect) {
+		return
+	}
+
+	dbStructure.LastNotificationID++
+	notification.ID = dbStructure.LastNotificationID
+	notification.CreatedAt = time.Now().UTC()
+	notifications := append(dbStructure.Notifications[userID], notification)
+	if len(notifications) > maxNotificationsPerUser {
+		notifications = slices.Delete(notifications, 0, len(notifications)-maxNotificationsPerUser)
+	}
+	dbStructure.Notifications[userID] = notifications
+}
+
+// notifyChirp sends the reply and mention notifications for a new or edited
+// chirp. mentioned is the set of users to notify of a mention; someone both
+// replied to and mentioned only hears about the reply.
+func (dbStructure *DBStructure) notifyChirp(chirp Chirp, mentioned []int, notifyReply bool) {
+	parentAuthorID := 0
+	if chirp.InReplyTo != 0 {
+		parentAuthorID = dbStructure.Chirps[chirp.InReplyTo].AuthorID
+		if notifyReply {
+			dbStructure.notify(parentAuthorID, Notification{Type: notificationReply, ActorID: chirp.AuthorID, ChirpID: chirp.ID})
+		}
+	}
+	for _, userID := range mentioned {
+		if userID == parentAuthorID {
+			continue
+		}
+		dbStructure.notify(userID, Notification{Type: notificationMention, ActorID: chirp.AuthorID, ChirpID: chirp.ID})
+	}
+}
+
+// removeNotifications drops the notifications matching fn, e.g. those about
+// a deleted chirp or a reaction that was taken back.
+func (dbStructure *DBStructure) removeNotifications(fn func(userID int, notification Notification) bool) {
+	for userID, notifications := range dbStructure.Notifications {
+		notifications = slices.DeleteFunc(notifications, func(notification Notification) bool {
+			return fn(userID, notification)
+		})
+		if len(notifications) == 0 {
+			delete(dbStructure.Notifications, userID)
+			continue
+		}
+		dbStructure.Notifications[userID] = notifications
+	}
+}
+
+func unreadCount(notifications []Notification) int {
+	count := 0
+	for _, notification := range notifications {
+		if notification.ReadAt == nil {
+			count++
+		}
+	}
+	return count
+}
+
+// markNotificationsRead marks one notification read, or all of them when
+// notificationID is 0, and returns the new unread count.
+func markNotificationsRead(db *DB, userID, notificationID int) (int, error) {
+	unread := 0
+	err := db.update(func(dbStructure *DBStructure) error {
+		now := time.Now().UTC()
+		notifications := dbStructure.Notifications[userID]
+		found := false
+		for i := range notifications {
+			if notificationID != 0 && notifications[i].ID != notificationID {
+				continue
+			}
+			found = true
+			if notifications[i].ReadAt == nil {
+				notifications[i].ReadAt = &now
+			}
+		}
+		if notificationID != 0 && !found {
+			return errNotificationNotFound
+		}
+		unread = unreadCount(notifications)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return unread, nil
+}
+
+type notificationResponse struct {
+	Notification
+	// the chirp the notification is about, if it's still visible
+	Chirp *Chirp `json:"chirp,omitempty"`
+}
+
+/*
+route: /api/notifications?unread={true, optional}&limit={optional}&cursor={optional}
+method: GET
+
+Newest first. unread_count always covers every unread notification, not just
+the page.
+
+	req headers: {
+		Authorization string (jwtToken or access token with chirps:read)
+	}
+*/
+func (config *apiConfig) getNotificationsHandler(w http.ResponseWriter, req *http.Request) {
+	id, scopes, err := config.authenticateWithScopes(req, scopeChirpsRead)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	limit, cursor, err := pageRequest(req, "notifications")
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	unreadOnly := req.URL.Query().Get("unread") == "true"
+
+	dbStructure, err := config.db.LoadDB()
+	if err != nil {
+		respondWithError(w, 500, err.Error())
+		return
+	}
+
+	notifications := []Notification{}
+	for _, notification := range dbStructure.Notifications[id] {
+		if !unreadOnly || notification.ReadAt == nil {
+			notifications = append(notifications, notification)
+		}
+	}
+	sort.Slice(notifications, func(i, j int) bool {
+		return byTimeDesc(notificationKey(notifications[i]), notificationKey(notifications[j]))
+	})
+
+	page, next, prev := paginate(notifications, notificationKey, byTimeDesc, limit, cursor)
+	viewer := chirpViewer{ID: id, Scopes: scopes}
+	responses := []notificationResponse{}
+	for _, notification := range page {
+		response := notificationResponse{Notification: notification}
+		chirp, found := dbStructure.Chirps[notification.ChirpID]
+		if found && !chirp.Hidden && canViewChirp(dbStructure, viewer, chirp, readDirect) {
+			chirps := []Chirp{chirp}
+			prepareChirps(dbStructure, viewer, chirps)
+			response.Chirp = &chirps[0]
+		}
+		responses = append(responses, response)
+	}
+	nextCursor, prevCursor := pageLinks(w, req, "notifications", next, prev)
+
+	respondWithJSON(w, 200, struct {
+		Notifications []notificationResponse `json:"notifications"`
+		UnreadCount   int                    `json:"unread_count"`
+		NextCursor    string                 `json:"next_cursor,omitempty"`
+		PrevCursor    string                 `json:"prev_cursor,omitempty"`
+	}{
+		Notifications: responses,
+		UnreadCount:   unreadCount(dbStructure.Notifications[id]),
+		NextCursor:    nextCursor,
+		PrevCursor:    prevCursor,
+	})
+}
+
+/*
+route: /api/notifications/read and /api/notifications/{notificationID}/read
+method: POST
+
+Marks every notification, or just the one in the path, as read.
+
+	req headers: {
+		Authorization string (jwtToken or access token with users:write)
+	}
+*/
+func (config *apiConfig) markNotificationsReadHandler(w http.ResponseWriter, req *http.Request) {
+	id, err := config.authenticate(req, scopeUsersWrite)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	notificationID := 0
+	if idText := req.PathValue("notificationID"); idText != "" {
+		notificationID, err = strconv.Atoi(idText)
+		if err != nil || notificationID <= 0 {
+			respondWithError(w, 400, "invalid notification id")
+			return
+		}
+	}
+
+	unread, err := markNotificationsRead(config.db, id, notificationID)
+	if err != nil {
+		if errors.Is(err, errNotificationNotFound) {
+			respondWithError(w, 404, err.Error())
+			return
+		}
+		respondWithError(w, 500, err.Error())
+		return
+	}
+
+	respondWithJSON(w, 200, struct {
+		UnreadCount int `json:"unread_count"`
+	}{
+		UnreadCount: unread,
+	})
+}
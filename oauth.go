@@ -0,0 +1,671 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+type OAuthClient struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// empty for public clients, which authenticate with PKCE alone
+	SecretHash   string    `json:"secret_hash,omitempty"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	OwnerID      int       `json:"owner_id"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+type AuthorizationCode struct {
+	ClientID      string    `json:"client_id"`
+	UserID        int       `json:"user_id"`
+	RedirectURI   string    `json:"redirect_uri"`
+	Scopes        []string  `json:"scopes"`
+	CodeChallenge string    `json:"code_challenge"`
+	ExpiresAt     time.Time `json:"expires_at"`
+}
+
+const (
+	authorizationCodeLifetime = 10 * time.Minute
+	accessTokenLifetime       = time.Hour
+)
+
+var (
+	errInvalidClient = errors.New("invalid client")
+	errInvalidGrant  = errors.New("invalid grant")
+)
+
+func registerOAuthClient(db *DB, ownerID int, name string, redirectURIs []string, public bool) (OAuthClient, string, error) {
+	client := OAuthClient{
+		ID:           generateRefreshToken()[:32],
+		Name:         name,
+		RedirectURIs: redirectURIs,
+		OwnerID:      ownerID,
+		CreatedAt:    time.Now().UTC(),
+	}
+
+	secret := ""
+	if !public {
+		secret = generateRefreshToken()
+		client.SecretHash = hashToken(secret)
+	}
+
+	err := db.update(func(dbStructure *DBStructure) error {
+		dbStructure.OAuthClients[client.ID] = client
+		return nil
+	})
+	if err != nil {
+		return OAuthClient{}, "", err
+	}
+
+	return client, secret, nil
+}
+
+func findOAuthClient(db *DB, clientID string) (OAuthClient, error) {
+	dbStructure, err := db.LoadDB()
+	if err != nil {
+		return OAuthClient{}, err
+	}
+
+	client, found := dbStructure.OAuthClients[clientID]
+	if !found {
+		return OAuthClient{}, errInvalidClient
+	}
+
+	return client, nil
+}
+
+// authenticateOAuthClient accepts client_secret_basic or client_secret_post
+// credentials. Public clients only have to identify themselves.
+func authenticateOAuthClient(db *DB, req *http.Request) (OAuthClient, error) {
+	clientID, secret, hasBasic := req.BasicAuth()
+	if !hasBasic {
+		clientID = req.PostForm.Get("client_id")
+		secret = req.PostForm.Get("client_secret")
+	}
+
+	client, err := findOAuthClient(db, clientID)
+	if err != nil {
+		return OAuthClient{}, err
+	}
+
+	if client.SecretHash == "" {
+		return client, nil
+	}
+	if subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(client.SecretHash)) != 1 {
+		return OAuthClient{}, errInvalidClient
+	}
+
+	return client, nil
+}
+
+// parseScopes reads the scopes a client asks for. Third-party clients can't be
+// granted the admin scope; only the user can hand that out, as a personal
+// access token.
+func parseScopes(scope string) ([]string, bool) {
+	scopes := strings.Fields(scope)
+	if len(scopes) == 0 {
+		return []string{scopeChirpsRead}, true
+	}
+
+	for _, s := range scopes {
+		if s == scopeAdmin || !slices.Contains(validScopes, s) {
+			return nil, false
+		}
+	}
+	return scopes, true
+}
+
+func saveAuthorizationCode(db *DB, authCode AuthorizationCode) (string, error) {
+	code := generateRefreshToken()
+	err := db.update(func(dbStructure *DBStructure) error {
+		// drop codes that were never redeemed
+		for hash, existing := range dbStructure.AuthorizationCodes {
+			if time.Now().UTC().After(existing.ExpiresAt) {
+				delete(dbStructure.AuthorizationCodes, hash)
+			}
+		}
+		dbStructure.AuthorizationCodes[hashToken(code)] = authCode
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return code, nil
+}
+
+// redeemAuthorizationCode consumes the code, so a code can only ever be
+// exchanged once even if the exchange fails later on.
+func redeemAuthorizationCode(db *DB, code string) (AuthorizationCode, error) {
+	authCode := AuthorizationCode{}
+	err := db.update(func(dbStructure *DBStructure) error {
+		hash := hashToken(code)
+		found := false
+		authCode, found = dbStructure.AuthorizationCodes[hash]
+		if !found {
+			return errInvalidGrant
+		}
+		delete(dbStructure.AuthorizationCodes, hash)
+		return nil
+	})
+	if err != nil {
+		return AuthorizationCode{}, err
+	}
+
+	if time.Now().UTC().After(authCode.ExpiresAt) {
+		return AuthorizationCode{}, errInvalidGrant
+	}
+
+	return authCode, nil
+}
+
+func verifyCodeChallenge(challenge, verifier string) bool {
+	sum := sha256.Sum256([]byte(verifier))
+	computed := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(challenge)) == 1
+}
+
+func saveClientRefreshToken(db *DB, userID int, clientID string, scopes []string) (string, error) {
+	token := generateRefreshToken()
+	err := db.update(func(dbStructure *DBStructure) error {
+		user, found := dbStructure.Users[userID]
+		if !found {
+			return errors.New("user not found")
+		}
+		user.ClientRefreshTokens = append(user.ClientRefreshTokens, RefreshToken{
+			Token:      token,
+			CreatedAt:  time.Now().UTC(),
+			DaysActive: 60,
+			ClientID:   clientID,
+			Scopes:     scopes,
+		})
+		dbStructure.Users[userID] = user
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// rotateClientRefreshToken swaps a client's refresh token for a new one and
+// returns the user and scopes of the grant.
+func rotateClientRefreshToken(db *DB, clientID, refreshToken string) (int, []string, string, error) {
+	newToken := generateRefreshToken()
+	userID := 0
+	scopes := []string{}
+
+	err := db.update(func(dbStructure *DBStructure) error {
+		for id, user := range dbStructure.Users {
+			for i, grant := range user.ClientRefreshTokens {
+				if grant.Token != refreshToken || grant.ClientID != clientID {
+					continue
+				}
+				if time.Now().UTC().After(grant.CreatedAt.AddDate(0, 0, grant.DaysActive)) {
+					return errInvalidGrant
+				}
+
+				userID = id
+				scopes = grant.Scopes
+				user.ClientRefreshTokens[i].Token = newToken
+				user.ClientRefreshTokens[i].CreatedAt = time.Now().UTC()
+				dbStructure.Users[id] = user
+				return nil
+			}
+		}
+		return errInvalidGrant
+	})
+	if err != nil {
+		return 0, nil, "", err
+	}
+
+	return userID, scopes, newToken, nil
+}
+
+func revokeClientRefreshToken(db *DB, clientID, refreshToken string) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		for id, user := range dbStructure.Users {
+			for i, grant := range user.ClientRefreshTokens {
+				if grant.Token == refreshToken && grant.ClientID == clientID {
+					user.ClientRefreshTokens = slices.Delete(user.ClientRefreshTokens, i, i+1)
+					dbStructure.Users[id] = user
+					return nil
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func respondWithOAuthError(w http.ResponseWriter, statusCode int, code, description string) {
+	w.Header().Set("Cache-Control", "no-store")
+	respondWithJSON(w, statusCode, struct {
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description,omitempty"`
+	}{
+		Error:            code,
+		ErrorDescription: description,
+	})
+}
+
+func redirectWithParams(w http.ResponseWriter, req *http.Request, redirectURI string, params url.Values) {
+	target, err := url.Parse(redirectURI)
+	if err != nil {
+		respondWithError(w, 400, "invalid redirect_uri")
+		return
+	}
+	query := target.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	target.RawQuery = query.Encode()
+	http.Redirect(w, req, target.String(), http.StatusFound)
+}
+
+/*
+route: /api/oauth/clients
+method: POST
+
+	req body shape: {
+		name string
+		redirect_uris []string
+		public bool (optional, public clients get no secret)
+	}
+
+	req headers: {
+		Authorization string (jwtToken)
+	}
+
+The client secret is only returned in this response.
+*/
+func (config *apiConfig) registerOAuthClientHandler(w http.ResponseWriter, req *http.Request) {
+	id, err := config.authenticateSession(req)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	params, err := decodeJSON(req)
+	if err != nil {
+		respondWithError(w, 500, "error decoding request body")
+		return
+	}
+
+	if params.Name == "" {
+		respondWithError(w, 400, "client name is required")
+		return
+	}
+	if len(params.RedirectURIs) == 0 {
+		respondWithError(w, 400, "at least one redirect uri is required")
+		return
+	}
+	for _, redirectURI := range params.RedirectURIs {
+		parsed, err := url.Parse(redirectURI)
+		if err != nil || !parsed.IsAbs() || parsed.Fragment != "" {
+			respondWithError(w, 400, "invalid redirect uri: "+redirectURI)
+			return
+		}
+	}
+
+	client, secret, err := registerOAuthClient(config.db, id, params.Name, params.RedirectURIs, params.Public)
+	if err != nil {
+		respondWithError(w, 500, err.Error())
+		return
+	}
+
+	respondWithJSON(w, 201, struct {
+		ClientID     string   `json:"client_id"`
+		ClientSecret string   `json:"client_secret,omitempty"`
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+	}{
+		ClientID:     client.ID,
+		ClientSecret: secret,
+		Name:         client.Name,
+		RedirectURIs: client.RedirectURIs,
+	})
+}
+
+var consentTemplate = template.Must(template.New("consent").Parse(`<!DOCTYPE html><html>
+	<body>
+		<h1>Authorize {{.ClientName}}</h1>
+		<p>{{.ClientName}} would like to:</p>
+		<ul>
+		{{range .Scopes}}<li>{{.}}</li>{{end}}
+		</ul>
+		{{if .Error}}<p style="color: red">{{.Error}}</p>{{end}}
+		<form method="POST" action="/oauth/authorize">
+			<input type="hidden" name="client_id" value="{{.ClientID}}">
+			<input type="hidden" name="redirect_uri" value="{{.RedirectURI}}">
+			<input type="hidden" name="scope" value="{{.Scope}}">
+			<input type="hidden" name="state" value="{{.State}}">
+			<input type="hidden" name="code_challenge" value="{{.CodeChallenge}}">
+			<label>Email <input type="email" name="email"></label>
+			<label>Password <input type="password" name="password"></label>
+			<button type="submit" name="decision" value="approve">Approve</button>
+			<button type="submit" name="decision" value="deny">Deny</button>
+		</form>
+	</body>
+</html>`))
+
+type consentPage struct {
+	ClientName    string
+	ClientID      string
+	RedirectURI   string
+	Scope         string
+	Scopes        []string
+	State         string
+	CodeChallenge string
+	Error         string
+}
+
+/*
+validateAuthorizeRequest checks the parameters shared by the consent page and
+the consent form. When ok is false a response has already been written:
+problems with the client or redirect uri are shown to the user, anything else
+is sent back to the client's redirect uri as the spec requires.
+*/
+func (config *apiConfig) validateAuthorizeRequest(w http.ResponseWriter, req *http.Request, values url.Values) (consentPage, []string, bool) {
+	client, err := findOAuthClient(config.db, values.Get("client_id"))
+	if err != nil {
+		respondWithError(w, 400, "unknown client_id")
+		return consentPage{}, nil, false
+	}
+
+	redirectURI := values.Get("redirect_uri")
+	if !slices.Contains(client.RedirectURIs, redirectURI) {
+		respondWithError(w, 400, "redirect_uri is not registered for this client")
+		return consentPage{}, nil, false
+	}
+
+	state := values.Get("state")
+	fail := func(code, description string) {
+		redirectWithParams(w, req, redirectURI, url.Values{
+			"error":             {code},
+			"error_description": {description},
+			"state":             {state},
+		})
+	}
+
+	scopes, ok := parseScopes(values.Get("scope"))
+	if !ok {
+		fail("invalid_scope", "unknown scope requested")
+		return consentPage{}, nil, false
+	}
+
+	// PKCE is mandatory and only S256 is supported
+	if values.Get("code_challenge") == "" {
+		fail("invalid_request", "code_challenge is required")
+		return consentPage{}, nil, false
+	}
+
+	return consentPage{
+		ClientName:    client.Name,
+		ClientID:      client.ID,
+		RedirectURI:   redirectURI,
+		Scope:         strings.Join(scopes, " "),
+		Scopes:        scopes,
+		State:         state,
+		CodeChallenge: values.Get("code_challenge"),
+	}, scopes, true
+}
+
+/*
+route: /oauth/authorize?response_type=code&client_id=&redirect_uri=&scope=&state=&code_challenge=&code_challenge_method=S256
+method: GET
+
+Renders the consent page. Any scope but admin can be requested.
+*/
+func (config *apiConfig) authorizeHandler(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	page, _, ok := config.validateAuthorizeRequest(w, req, query)
+	if !ok {
+		return
+	}
+
+	if query.Get("response_type") != "code" {
+		redirectWithParams(w, req, page.RedirectURI, url.Values{
+			"error": {"unsupported_response_type"},
+			"state": {page.State},
+		})
+		return
+	}
+	if query.Get("code_challenge_method") != "S256" {
+		redirectWithParams(w, req, page.RedirectURI, url.Values{
+			"error":             {"invalid_request"},
+			"error_description": {"code_challenge_method must be S256"},
+			"state":             {page.State},
+		})
+		return
+	}
+
+	renderConsentPage(w, 200, page)
+}
+
+func renderConsentPage(w http.ResponseWriter, statusCode int, page consentPage) {
+	w.Header().Set("Content-Type", "text/html")
+	// the consent page must never be framed by the client
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.WriteHeader(statusCode)
+	err := consentTemplate.Execute(w, page)
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+/*
+route: /oauth/authorize
+method: POST
+
+	form fields: {
+		client_id, redirect_uri, scope, state, code_challenge (from the consent page)
+		email string
+		password string
+		decision "approve" | "deny"
+	}
+*/
+func (config *apiConfig) authorizeConsentHandler(w http.ResponseWriter, req *http.Request) {
+	err := req.ParseForm()
+	if err != nil {
+		respondWithError(w, 400, "invalid form")
+		return
+	}
+
+	page, scopes, ok := config.validateAuthorizeRequest(w, req, req.PostForm)
+	if !ok {
+		return
+	}
+
+	if req.PostForm.Get("decision") != "approve" {
+		redirectWithParams(w, req, page.RedirectURI, url.Values{
+			"error": {"access_denied"},
+			"state": {page.State},
+		})
+		return
+	}
+
+	user, err := findUser(config.db, req.PostForm.Get("email"))
+	if err != nil {
+		page.Error = "incorrect email or password"
+		renderConsentPage(w, 401, page)
+		return
+	}
+	match, err := config.db.hasher.Verify(user.Password, req.PostForm.Get("password"))
+	if err != nil || !match {
+		page.Error = "incorrect email or password"
+		renderConsentPage(w, 401, page)
+		return
+	}
+	if user.SuspendedAt != nil {
+		page.Error = errAccountSuspended.Error()
+		renderConsentPage(w, 403, page)
+		return
+	}
+	if user.PasswordResetRequired {
+		page.Error = errPasswordResetRequired.Error()
+		renderConsentPage(w, 403, page)
+		return
+	}
+
+	code, err := saveAuthorizationCode(config.db, AuthorizationCode{
+		ClientID:      page.ClientID,
+		UserID:        user.ID,
+		RedirectURI:   page.RedirectURI,
+		Scopes:        scopes,
+		CodeChallenge: page.CodeChallenge,
+		ExpiresAt:     time.Now().UTC().Add(authorizationCodeLifetime),
+	})
+	if err != nil {
+		respondWithError(w, 500, err.Error())
+		return
+	}
+
+	redirectWithParams(w, req, page.RedirectURI, url.Values{
+		"code":  {code},
+		"state": {page.State},
+	})
+}
+
+/*
+route: /oauth/token
+method: POST
+
+	form fields (grant_type=authorization_code): {
+		code string
+		redirect_uri string
+		code_verifier string
+		client_id string
+		client_secret string (confidential clients, or use HTTP basic auth)
+	}
+
+	form fields (grant_type=refresh_token): {
+		refresh_token string
+		client_id string
+		client_secret string (confidential clients, or use HTTP basic auth)
+	}
+*/
+func (config *apiConfig) tokenHandler(w http.ResponseWriter, req *http.Request) {
+	err := req.ParseForm()
+	if err != nil {
+		respondWithOAuthError(w, 400, "invalid_request", "invalid form body")
+		return
+	}
+
+	client, err := authenticateOAuthClient(config.db, req)
+	if err != nil {
+		respondWithOAuthError(w, 401, "invalid_client", "client authentication failed")
+		return
+	}
+
+	userID := 0
+	scopes := []string{}
+	refreshToken := ""
+
+	switch req.PostForm.Get("grant_type") {
+	case "authorization_code":
+		authCode, err := redeemAuthorizationCode(config.db, req.PostForm.Get("code"))
+		if err != nil {
+			respondWithOAuthError(w, 400, "invalid_grant", "authorization code is invalid or expired")
+			return
+		}
+		if authCode.ClientID != client.ID || authCode.RedirectURI != req.PostForm.Get("redirect_uri") {
+			respondWithOAuthError(w, 400, "invalid_grant", "authorization code was issued to another client")
+			return
+		}
+		if !verifyCodeChallenge(authCode.CodeChallenge, req.PostForm.Get("code_verifier")) {
+			respondWithOAuthError(w, 400, "invalid_grant", "code_verifier does not match code_challenge")
+			return
+		}
+
+		userID = authCode.UserID
+		scopes = authCode.Scopes
+		refreshToken, err = saveClientRefreshToken(config.db, userID, client.ID, scopes)
+		if err != nil {
+			respondWithOAuthError(w, 500, "server_error", err.Error())
+			return
+		}
+	case "refresh_token":
+		userID, scopes, refreshToken, err = rotateClientRefreshToken(config.db, client.ID, req.PostForm.Get("refresh_token"))
+		if err != nil {
+			respondWithOAuthError(w, 400, "invalid_grant", "refresh token is invalid or expired")
+			return
+		}
+	default:
+		respondWithOAuthError(w, 400, "unsupported_grant_type", "")
+		return
+	}
+
+	accessToken, err := createScopedJWT(config.jwtSecret, userID, client.ID, scopes)
+	if err != nil {
+		respondWithOAuthError(w, 500, "server_error", err.Error())
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	respondWithJSON(w, 200, struct {
+		AccessToken  string `json:"access_token"`
+		TokenType    string `json:"token_type"`
+		ExpiresIn    int    `json:"expires_in"`
+		RefreshToken string `json:"refresh_token"`
+		Scope        string `json:"scope"`
+	}{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(accessTokenLifetime.Seconds()),
+		RefreshToken: refreshToken,
+		Scope:        strings.Join(scopes, " "),
+	})
+}
+
+/*
+route: /oauth/revoke
+method: POST
+
+	form fields: {
+		token string (refresh token)
+		client_id string
+		client_secret string (confidential clients, or use HTTP basic auth)
+	}
+
+Access tokens are short-lived JWTs and cannot be revoked individually, so
+they get unsupported_token_type; revoking the refresh token ends the grant.
+Unknown tokens are not an error.
+*/
+func (config *apiConfig) revokeOAuthTokenHandler(w http.ResponseWriter, req *http.Request) {
+	err := req.ParseForm()
+	if err != nil {
+		respondWithOAuthError(w, 400, "invalid_request", "invalid form body")
+		return
+	}
+
+	client, err := authenticateOAuthClient(config.db, req)
+	if err != nil {
+		respondWithOAuthError(w, 401, "invalid_client", "client authentication failed")
+		return
+	}
+
+	token := req.PostForm.Get("token")
+	// refresh tokens are hex, so anything shaped like a JWT is an access token
+	if strings.Count(token, ".") == 2 {
+		respondWithOAuthError(w, 400, "unsupported_token_type", "access tokens expire on their own; revoke the refresh token instead")
+		return
+	}
+
+	err = revokeClientRefreshToken(config.db, client.ID, token)
+	if err != nil {
+		respondWithOAuthError(w, 500, "server_error", err.Error())
+		return
+	}
+
+	w.WriteHeader(200)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+pageCursor marks a position in a list by the sort key of the item next to it
+rather than by offset, so pages stay stable while items are added or removed.
+Clients only ever see it as an opaque string.
+*/
+type pageCursor struct {
+	Sort      string    `json:"s,omitempty"`
+	CreatedAt time.Time `json:"t,omitempty"`
+	ID        int       `json:"i"`
+	Score     float64   `json:"r,omitempty"`
+	// set on cursors that point at the previous page
+	Before bool `json:"b,omitempty"`
+}
+
+// keyLess orders two cursor keys the same way the list being paged is sorted.
+type keyLess func(a, b pageCursor) bool
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+func byIDAsc(a, b pageCursor) bool  { return a.ID < b.ID }
+func byIDDesc(a, b pageCursor) bool { return a.ID > b.ID }
+
+func byTimeAsc(a, b pageCursor) bool {
+	if a.CreatedAt.Equal(b.CreatedAt) {
+		return a.ID < b.ID
+	}
+	return a.CreatedAt.Before(b.CreatedAt)
+}
+
+func byTimeDesc(a, b pageCursor) bool { return byTimeAsc(b, a) }
+
+func byScoreDesc(a, b pageCursor) bool {
+	if a.Score == b.Score {
+		return a.ID > b.ID
+	}
+	return a.Score > b.Score
+}
+
+// chirpSortLess maps the sort query parameter of chirp listings to the
+// matching key order.
+func chirpSortLess(sortName string) keyLess {
+	switch sortName {
+	case chirpSortDesc:
+		return byIDDesc
+	case chirpSortCreatedAt:
+		return byTimeAsc
+	case chirpSortCreatedAtDesc:
+		return byTimeDesc
+	default:
+		return byIDAsc
+	}
+}
+
+func chirpKey(chirp Chirp) pageCursor {
+	return pageCursor{CreatedAt: chirp.CreatedAt, ID: chirp.ID}
+}
+
+func encodeCursor(cursor pageCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(encoded string) (pageCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return pageCursor{}, errInvalidCursor
+	}
+	cursor := pageCursor{}
+	err = json.Unmarshal(data, &cursor)
+	if err != nil {
+		return pageCursor{}, errInvalidCursor
+	}
+	return cursor, nil
+}
+
+/*
+paginate returns the page of items (already sorted by less) that follows the
+cursor, or precedes it for a Before cursor, plus cursors for the neighbouring
+pages. A nil cursor starts at the beginning.
+*/
+func paginate[T any](items []T, keyOf func(T) pageCursor, less keyLess, limit int, cursor *pageCursor) ([]T, *pageCursor, *pageCursor) {
+	start, end := 0, min(limit, len(items))
+	if cursor != nil && !cursor.Before {
+		start = sort.Search(len(items), func(i int) bool { return less(*cursor, keyOf(items[i])) })
+		end = min(start+limit, len(items))
+	}
+	if cursor != nil && cursor.Before {
+		end = sort.Search(len(items), func(i int) bool { return !less(keyOf(items[i]), *cursor) })
+		start = max(0, end-limit)
+	}
+
+	page := items[start:end]
+	var next, prev *pageCursor
+	if end < len(items) && len(page) > 0 {
+		key := keyOf(page[len(page)-1])
+		next = &key
+	}
+	if start > 0 && len(page) > 0 {
+		key := keyOf(page[0])
+		key.Before = true
+		prev = &key
+	}
+
+	return page, next, prev
+}
+
+// pageRequest reads the limit and cursor query parameters. sortName ties a
+// cursor to the ordering it was issued for.
+func pageRequest(req *http.Request, sortName string) (int, *pageCursor, error) {
+	limit := defaultPageSize
+	if limitText := req.URL.Query().Get("limit"); limitText != "" {
+		parsed, err := strconv.Atoi(limitText)
+		if err != nil || parsed <= 0 {
+			return 0, nil, errors.New("limit must be a positive integer")
+		}
+		limit = min(parsed, maxPageSize)
+	}
+
+	encoded := req.URL.Query().Get("cursor")
+	if encoded == "" {
+		return limit, nil, nil
+	}
+	cursor, err := decodeCursor(encoded)
+	if err != nil {
+		return 0, nil, err
+	}
+	if cursor.Sort != sortName {
+		return 0, nil, errors.New("cursor was issued for a different sort order")
+	}
+
+	return limit, &cursor, nil
+}
+
+/*
+pageLinks encodes the neighbouring cursors and sets an RFC 8288 Link header
+pointing at them, keeping every other query parameter of the request.
+*/
+func pageLinks(w http.ResponseWriter, req *http.Request, sortName string, next, prev *pageCursor) (string, string) {
+	links := []string{}
+	encode := func(cursor *pageCursor, rel string) string {
+		if cursor == nil {
+			return ""
+		}
+		cursor.Sort = sortName
+		encoded := encodeCursor(*cursor)
+
+		query := req.URL.Query()
+		query.Set("cursor", encoded)
+		links = append(links, fmt.Sprintf(`<%s?%s>; rel="%s"`, req.URL.Path, query.Encode(), rel))
+		return encoded
+	}
+
+	nextCursor := encode(next, "next")
+	prevCursor := encode(prev, "prev")
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+
+	return nextCursor, prevCursor
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	createdAt := time.Date(2024, 3, 1, 12, 30, 45, 123456789, time.UTC)
+	tests := []struct {
+		name   string
+		cursor pageCursor
+	}{
+		{"zero", pageCursor{}},
+		{"id only", pageCursor{ID: 42}},
+		{"chirp key", pageCursor{Sort: "new", CreatedAt: createdAt, ID: 7}},
+		{"previous page", pageCursor{Sort: "new", CreatedAt: createdAt, ID: 7, Before: true}},
+		{"score", pageCursor{Sort: "top", ID: 3, Score: 12.5}},
+		{"other time zone", pageCursor{CreatedAt: createdAt.In(time.FixedZone("", -5*60*60)), ID: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeCursor(encodeCursor(tt.cursor))
+			if err != nil {
+				t.Fatalf("decodeCursor() error = %v", err)
+			}
+			if !got.CreatedAt.Equal(tt.cursor.CreatedAt) {
+				t.Errorf("CreatedAt = %v, want %v", got.CreatedAt, tt.cursor.CreatedAt)
+			}
+			got.CreatedAt = tt.cursor.CreatedAt
+			if got != tt.cursor {
+				t.Errorf("decodeCursor(encodeCursor(%+v)) = %+v", tt.cursor, got)
+			}
+		})
+	}
+}
+
+func TestDecodeCursorInvalid(t *testing.T) {
+	for _, encoded := range []string{"not base64!", "bm90IGpzb24", "W10"} {
+		_, err := decodeCursor(encoded)
+		if !errors.Is(err, errInvalidCursor) {
+			t.Errorf("decodeCursor(%q) error = %v, want %v", encoded, err, errInvalidCursor)
+		}
+	}
+}
+
+// Walking the next cursors, through their encoded form, visits every item
+// once, and each prev cursor leads back to the page before.
+func TestPaginateWalk(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	chirps := []Chirp{}
+	for id := 1; id <= 7; id++ {
+		// pairs of chirps share a timestamp, so ties are broken by id
+		chirps = append(chirps, Chirp{ID: id, CreatedAt: start.Add(time.Duration(id/2) * time.Minute)})
+	}
+	slices.SortFunc(chirps, func(a, b Chirp) int {
+		if byTimeDesc(chirpKey(a), chirpKey(b)) {
+			return -1
+		}
+		return 1
+	})
+
+	pages := [][]Chirp{}
+	var cursor *pageCursor
+	for {
+		page, next, prev := paginate(chirps, chirpKey, byTimeDesc, 3, cursor)
+		pages = append(pages, page)
+
+		if len(pages) > 1 {
+			if prev == nil {
+				t.Fatalf("page %d has no prev cursor", len(pages))
+			}
+			decoded, err := decodeCursor(encodeCursor(*prev))
+			if err != nil {
+				t.Fatal(err)
+			}
+			back, _, _ := paginate(chirps, chirpKey, byTimeDesc, 3, &decoded)
+			if !slices.EqualFunc(back, pages[len(pages)-2], func(a, b Chirp) bool { return a.ID == b.ID }) {
+				t.Errorf("prev of page %d = %v, want %v", len(pages), back, pages[len(pages)-2])
+			}
+		} else if prev != nil {
+			t.Errorf("first page has a prev cursor")
+		}
+
+		if next == nil {
+			break
+		}
+		decoded, err := decodeCursor(encodeCursor(*next))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cursor = &decoded
+	}
+
+	seen := []int{}
+	for _, page := range pages {
+		for _, chirp := range page {
+			seen = append(seen, chirp.ID)
+		}
+	}
+	want := []int{7, 6, 5, 4, 3, 2, 1}
+	if !slices.Equal(seen, want) {
+		t.Errorf("walked %v, want %v", seen, want)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+/*
+PasswordHasher hashes and verifies user passwords.
+
+Stored hashes are self-describing (bcrypt's modular crypt format or the PHC
+string format for argon2id), so a hasher can verify hashes produced by any
+supported algorithm and report when a hash was made with outdated parameters.
+*/
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	Verify(encodedHash, password string) (bool, error)
+	NeedsRehash(encodedHash string) bool
+}
+
+type argon2Params struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+type passwordHasher struct {
+	algorithm  string
+	bcryptCost int
+	argon2     argon2Params
+}
+
+const (
+	hashAlgorithmBcrypt   = "bcrypt"
+	hashAlgorithmArgon2id = "argon2id"
+)
+
+var errUnknownHashFormat = errors.New("unknown password hash format")
+
+func NewPasswordHasher(algorithm string, bcryptCost int, params argon2Params) (PasswordHasher, error) {
+	switch algorithm {
+	case hashAlgorithmBcrypt:
+		if bcryptCost < bcrypt.MinCost || bcryptCost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	case hashAlgorithmArgon2id:
+		if params.Memory == 0 || params.Iterations == 0 || params.Parallelism == 0 {
+			return nil, errors.New("argon2id memory, iterations and parallelism must be positive")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported password hashing algorithm %q", algorithm)
+	}
+
+	return &passwordHasher{
+		algorithm:  algorithm,
+		bcryptCost: bcryptCost,
+		argon2:     params,
+	}, nil
+}
+
+func passwordHasherFromEnv() (PasswordHasher, error) {
+	algorithm := envString("PASSWORD_HASHER", hashAlgorithmBcrypt)
+	params := argon2Params{
+		Memory:      uint32(envInt("ARGON2_MEMORY_KIB", 64*1024)),
+		Iterations:  uint32(envInt("ARGON2_ITERATIONS", 3)),
+		Parallelism: uint8(envInt("ARGON2_PARALLELISM", 2)),
+		SaltLength:  16,
+		KeyLength:   32,
+	}
+	return NewPasswordHasher(algorithm, envInt("BCRYPT_COST", 12), params)
+}
+
+func (h *passwordHasher) Hash(password string) (string, error) {
+	if h.algorithm == hashAlgorithmArgon2id {
+		return h.hashArgon2id(password)
+	}
+
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), h.bcryptCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hashed), nil
+}
+
+func (h *passwordHasher) Verify(encodedHash, password string) (bool, error) {
+	if strings.HasPrefix(encodedHash, "$argon2id$") {
+		params, salt, key, err := decodeArgon2idHash(encodedHash)
+		if err != nil {
+			return false, err
+		}
+		computed := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+		return subtle.ConstantTimeCompare(key, computed) == 1, nil
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(encodedHash), []byte(password))
+	if err == nil {
+		return true, nil
+	}
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	return false, errUnknownHashFormat
+}
+
+// NeedsRehash reports whether the stored hash was produced by a different
+// algorithm or with weaker parameters than the hasher is configured for.
+func (h *passwordHasher) NeedsRehash(encodedHash string) bool {
+	if h.algorithm == hashAlgorithmArgon2id {
+		params, _, key, err := decodeArgon2idHash(encodedHash)
+		if err != nil {
+			return true
+		}
+		return params.Memory != h.argon2.Memory ||
+			params.Iterations != h.argon2.Iterations ||
+			params.Parallelism != h.argon2.Parallelism ||
+			uint32(len(key)) != h.argon2.KeyLength
+	}
+
+	cost, err := bcrypt.Cost([]byte(encodedHash))
+	if err != nil {
+		return true
+	}
+	return cost != h.bcryptCost
+}
+
+func (h *passwordHasher) hashArgon2id(password string) (string, error) {
+	salt := make([]byte, h.argon2.SaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, h.argon2.Iterations, h.argon2.Memory, h.argon2.Parallelism, h.argon2.KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		h.argon2.Memory,
+		h.argon2.Iterations,
+		h.argon2.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+/*
+decodeArgon2idHash parses a PHC string of the form
+
+	$argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>
+*/
+func decodeArgon2idHash(encodedHash string) (argon2Params, []byte, []byte, error) {
+	parts := strings.Split(encodedHash, "$")
+	if len(parts) != 6 || parts[1] != hashAlgorithmArgon2id {
+		return argon2Params{}, nil, nil, errUnknownHashFormat
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return argon2Params{}, nil, nil, errUnknownHashFormat
+	}
+
+	params := argon2Params{}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism)
+	if err != nil {
+		return argon2Params{}, nil, nil, errUnknownHashFormat
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return argon2Params{}, nil, nil, errUnknownHashFormat
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return argon2Params{}, nil, nil, errUnknownHashFormat
+	}
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+
+	return params, salt, key, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type passwordPolicy struct {
+	MinLength int
+	MaxLength int
+	breached  *breachedPasswords
+}
+
+type policyViolation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+/*
+breachedPasswords is a local copy of a k-anonymized breached-password corpus,
+in the "SHA1:COUNT" line format published by Have I Been Pwned. Hashes are
+bucketed by their five character prefix so a lookup only ever touches the
+suffixes that share a range with the candidate, the same way the remote range
+API works.
+*/
+type breachedPasswords struct {
+	ranges map[string]map[string]int
+}
+
+const breachedPrefixLength = 5
+
+func passwordPolicyFromEnv() (*passwordPolicy, error) {
+	policy := &passwordPolicy{
+		MinLength: envInt("PASSWORD_MIN_LENGTH", 8),
+		// bcrypt silently ignores everything past 72 bytes
+		MaxLength: envInt("PASSWORD_MAX_LENGTH", 72),
+	}
+
+	path := os.Getenv("BREACHED_PASSWORDS_FILE")
+	if path == "" {
+		return policy, nil
+	}
+
+	breached, err := loadBreachedPasswords(path)
+	if err != nil {
+		return nil, err
+	}
+	policy.breached = breached
+
+	return policy, nil
+}
+
+// Check returns every rule the password fails, or nil if it is acceptable.
+func (policy *passwordPolicy) Check(password string) []policyViolation {
+	violations := []policyViolation{}
+
+	if utf8.RuneCountInString(password) < policy.MinLength {
+		violations = append(violations, policyViolation{
+			Rule:    "min_length",
+			Message: fmt.Sprintf("password must be at least %d characters", policy.MinLength),
+		})
+	}
+
+	if len(password) > policy.MaxLength {
+		violations = append(violations, policyViolation{
+			Rule:    "max_length",
+			Message: fmt.Sprintf("password must be at most %d bytes", policy.MaxLength),
+		})
+	}
+
+	if policy.breached != nil && policy.breached.Contains(password) {
+		violations = append(violations, policyViolation{
+			Rule:    "breached",
+			Message: "password has appeared in a data breach and cannot be used",
+		})
+	}
+
+	if len(violations) == 0 {
+		return nil
+	}
+	return violations
+}
+
+func loadBreachedPasswords(path string) (*breachedPasswords, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	breached := &breachedPasswords{
+		ranges: make(map[string]map[string]int),
+	}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		hash, countText, _ := strings.Cut(line, ":")
+		if len(hash) != sha1.Size*2 {
+			continue
+		}
+		count, err := strconv.Atoi(countText)
+		if err != nil {
+			count = 1
+		}
+
+		hash = strings.ToUpper(hash)
+		prefix, suffix := hash[:breachedPrefixLength], hash[breachedPrefixLength:]
+		if breached.ranges[prefix] == nil {
+			breached.ranges[prefix] = make(map[string]int)
+		}
+		breached.ranges[prefix][suffix] = count
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return breached, nil
+}
+
+// Range returns the hash suffixes (and breach counts) that share a prefix.
+func (breached *breachedPasswords) Range(prefix string) map[string]int {
+	return breached.ranges[strings.ToUpper(prefix)]
+}
+
+func (breached *breachedPasswords) Contains(password string) bool {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	_, found := breached.Range(hash[:breachedPrefixLength])[hash[breachedPrefixLength:]]
+	return found
+}
+
+func respondWithPolicyViolations(w http.ResponseWriter, violations []policyViolation) {
+	respondWithJSON(w, 400, struct {
+		Error      string            `json:"error"`
+		Violations []policyViolation `json:"violations"`
+	}{
+		Error:      "password does not meet the password policy",
+		Violations: violations,
+	})
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+// chirpAuthor is the part of a profile embedded in chirps.
+type chirpAuthor struct {
+	ID          int    `json:"id"`
+	Handle      string `json:"handle,omitempty"`
+	DisplayName string `json:"display_name,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+}
+
+type profileResponse struct {
+	ID             int            `json:"id"`
+	Handle         string         `json:"handle"`
+	DisplayName    string         `json:"display_name"`
+	Bio            string         `json:"bio"`
+	Location       string         `json:"location"`
+	Website        string         `json:"website"`
+	Avatar         *mediaResponse `json:"avatar"`
+	FollowerCount  int            `json:"follower_count"`
+	FollowingCount int            `json:"following_count"`
+	ChirpCount     int            `json:"chirp_count"`
+}
+
+// profile field limits, in characters
+const (
+	maxDisplayNameLength = 50
+	maxBioLength         = 160
+	maxLocationLength    = 30
+	maxWebsiteLength     = 100
+)
+
+var (
+	errDisplayNameTooLong = errors.New("display_name must be at most 50 characters")
+	errBioTooLong         = errors.New("bio must be at most 160 characters")
+	errLocationTooLong    = errors.New("location must be at most 30 characters")
+	errInvalidWebsite     = errors.New("website must be an http or https URL of at most 100 characters")
+	errInvalidAvatar      = errors.New("avatar_media_id must refer to one of your uploads that isn't attached to a chirp")
+)
+
+// profileUpdate is everything a user can set on their profile besides the
+// handle.
+type profileUpdate struct {
+	DisplayName   string
+	Bio           string
+	Location      string
+	Website       string
+	AvatarMediaID string
+}
+
+func (update profileUpdate) validate() error {
+	switch {
+	case utf8.RuneCountInString(update.DisplayName) > maxDisplayNameLength:
+		return errDisplayNameTooLong
+	case utf8.RuneCountInString(update.Bio) > maxBioLength:
+		return errBioTooLong
+	case utf8.RuneCountInString(update.Location) > maxLocationLength:
+		return errLocationTooLong
+	}
+
+	if update.Website != "" {
+		website, err := url.Parse(update.Website)
+		if err != nil || len(update.Website) > maxWebsiteLength ||
+			(website.Scheme != "http" && website.Scheme != "https") || website.Host == "" {
+			return errInvalidWebsite
+		}
+	}
+	return nil
+}
+
+// avatarURL prefers the small thumbnail, falling back to the full image while
+// thumbnails are still being made or if the avatar is already small.
+func avatarURL(dbStructure DBStructure, user User) string {
+	media, found := dbStructure.Media[user.AvatarMediaID]
+	if !found {
+		return ""
+	}
+	for _, thumbnail := range media.Thumbnails {
+		if thumbnail.Size == "small" {
+			return "/api/media/" + media.ID + "?size=small"
+		}
+	}
+	return "/api/media/" + media.ID
+}
+
+func newChirpAuthor(dbStructure DBStructure, user User) chirpAuthor {
+	return chirpAuthor{
+		ID:          user.ID,
+		Handle:      user.Handle,
+		DisplayName: user.DisplayName,
+		AvatarURL:   avatarURL(dbStructure, user),
+	}
+}
+
+func attachAuthors(dbStructure DBStructure, chirps []Chirp) {
+	for i := range chirps {
+		user, found := dbStructure.Users[chirps[i].AuthorID]
+		if !found {
+			continue
+		}
+		author := newChirpAuthor(dbStructure, user)
+		chirps[i].Author = &author
+	}
+}
+
+// newProfileResponse renders the user's profile as viewer sees it; the chirp
+// count only covers chirps they can see.
+func newProfileResponse(dbStructure DBStructure, user User, viewer chirpViewer) profileResponse {
+	response := profileResponse{
+		ID:             user.ID,
+		Handle:         user.Handle,
+		DisplayName:    user.DisplayName,
+		Bio:            user.Bio,
+		Location:       user.Location,
+		Website:        user.Website,
+		FollowerCount:  len(dbStructure.Followers[user.ID]),
+		FollowingCount: len(dbStructure.Following[user.ID]),
+	}
+	if media, found := dbStructure.Media[user.AvatarMediaID]; found {
+		avatar := newMediaResponse(media)
+		response.Avatar = &avatar
+	}
+	for _, chirp := range dbStructure.Chirps {
+		if chirp.AuthorID == user.ID && canViewChirp(dbStructure, viewer, chirp, readAuthorListing) {
+			response.ChirpCount++
+		}
+	}
+	return response
+}
+
+// setAvatar makes mediaID the user's avatar, removing the one it replaces.
+// An empty mediaID just removes the current avatar.
+func (dbStructure *DBStructure) setAvatar(user *User, mediaID string) error {
+	if mediaID == user.AvatarMediaID {
+		return nil
+	}
+	if mediaID != "" {
+		media, found := dbStructure.Media[mediaID]
+		if !found || media.OwnerID != user.ID || media.ChirpID != 0 || media.Status == mediaStatusFailed {
+			return errInvalidAvatar
+		}
+		media.Avatar = true
+		dbStructure.Media[mediaID] = media
+	}
+
+	dbStructure.removeMedia(user.AvatarMediaID)
+	user.AvatarMediaID = mediaID
+	return nil
+}
+
+func updateProfile(db *DB, userID int, update profileUpdate) (profileResponse, error) {
+	err := update.validate()
+	if err != nil {
+		return profileResponse{}, err
+	}
+
+	response := profileResponse{}
+	err = db.update(func(dbStructure *DBStructure) error {
+		user, found := dbStructure.Users[userID]
+		if !found {
+			return errors.New("user not found")
+		}
+		err := dbStructure.setAvatar(&user, update.AvatarMediaID)
+		if err != nil {
+			return err
+		}
+		user.DisplayName = update.DisplayName
+		user.Bio = update.Bio
+		user.Location = update.Location
+		user.Website = update.Website
+		dbStructure.Users[userID] = user
+
+		response = newProfileResponse(*dbStructure, user, chirpViewer{ID: userID})
+		return nil
+	})
+	if err != nil {
+		return profileResponse{}, err
+	}
+
+	return response, nil
+}
+
+/*
+route: /api/users/me/profile
+method: PUT
+
+Replaces the whole profile; fields left out are cleared. Upload the avatar
+with POST /api/media first.
+
+	req body shape: {
+		display_name string
+		bio string
+		location string
+		website string
+		avatar_media_id string
+	}
+
+	req headers: {
+		Authorization string (jwtToken or access token with users:write)
+	}
+*/
+func (config *apiConfig) updateProfileHandler(w http.ResponseWriter, req *http.Request) {
+	id, err := config.authenticate(req, scopeUsersWrite)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	params, err := decodeJSON(req)
+	if err != nil {
+		respondWithError(w, 500, "error decoding request body")
+		return
+	}
+
+	profile, err := updateProfile(config.db, id, profileUpdate{
+		DisplayName:   cleanMessage(strings.TrimSpace(params.DisplayName)),
+		Bio:           cleanMessage(strings.TrimSpace(params.Bio)),
+		Location:      strings.TrimSpace(params.Location),
+		Website:       strings.TrimSpace(params.Website),
+		AvatarMediaID: params.AvatarMediaID,
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, errDisplayNameTooLong) || errors.Is(err, errBioTooLong) ||
+			errors.Is(err, errLocationTooLong) || errors.Is(err, errInvalidWebsite) ||
+			errors.Is(err, errInvalidAvatar):
+			respondWithError(w, 400, err.Error())
+		default:
+			respondWithError(w, 500, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, 200, profile)
+}
+
+/*
+route: /api/users/{handle}
+method: GET
+
+Public profile; the handle is matched ignoring case, with or without the @.
+Users who blocked the viewer, or whom the viewer blocked, aren't found.
+*/
+func (config *apiConfig) getProfileHandler(w http.ResponseWriter, req *http.Request) {
+	dbStructure, err := config.db.LoadDB()
+	if err != nil {
+		respondWithError(w, 500, err.Error())
+		return
+	}
+
+	viewer := config.optionalViewer(req)
+	user, found := findUserByHandle(dbStructure, strings.TrimPrefix(req.PathValue("handle"), "@"))
+	if !found || user.SuspendedAt != nil || dbStructure.isBlocked(viewer.ID, user.ID) {
+		respondWithError(w, 404, "user not found")
+		return
+	}
+
+	respondWithJSON(w, 200, newProfileResponse(dbStructure, user, viewer))
+}
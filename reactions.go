@@ -0,0 +1,262 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+)
+
+type Reaction struct {
+	UserID    int       `json:"user_id"`
+	Emoji     string    `json:"emoji"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// reactionEmoji is the allowlist of reactions, keyed by the name used in
+// URLs and stored in the database.
+var reactionEmoji = map[string]string{
+	"like":      "👍",
+	"heart":     "❤️",
+	"laugh":     "😂",
+	"surprised": "😮",
+	"sad":       "😢",
+	"angry":     "😠",
+}
+
+var errUnknownReaction = errors.New("unknown reaction")
+
+// reactionName accepts either the name of an allowed reaction or the emoji
+// itself and returns the name.
+func reactionName(emoji string) (string, error) {
+	if _, ok := reactionEmoji[emoji]; ok {
+		return emoji, nil
+	}
+	for name, value := range reactionEmoji {
+		if value == emoji {
+			return name, nil
+		}
+	}
+	return "", errUnknownReaction
+}
+
+func (dbStructure *DBStructure) recountReactions(chirpID int) {
+	chirp, found := dbStructure.Chirps[chirpID]
+	if !found {
+		return
+	}
+	chirp.Reactions = nil
+	for _, reaction := range dbStructure.Reactions[chirpID] {
+		if chirp.Reactions == nil {
+			chirp.Reactions = make(map[string]int)
+		}
+		chirp.Reactions[reaction.Emoji]++
+	}
+	dbStructure.Chirps[chirpID] = chirp
+}
+
+// removeUserReactions drops every reaction a user has left, used when the
+// account is purged.
+func (dbStructure *DBStructure) removeUserReactions(userID int) {
+	for chirpID, reactions := range dbStructure.Reactions {
+		before := len(reactions)
+		kept := slices.DeleteFunc(reactions, func(reaction Reaction) bool {
+			return reaction.UserID == userID
+		})
+		if len(kept) == before {
+			continue
+		}
+		if len(kept) == 0 {
+			delete(dbStructure.Reactions, chirpID)
+		} else {
+			dbStructure.Reactions[chirpID] = kept
+		}
+		dbStructure.recountReactions(chirpID)
+	}
+}
+
+// viewerReactions fills in which reactions the viewer has left on each
+// chirp. Anonymous viewers get nothing.
+func viewerReactions(dbStructure DBStructure, viewerID int, chirps []Chirp) {
+	if viewerID == 0 {
+		return
+	}
+	for i := range chirps {
+		for _, reaction := range dbStructure.Reactions[chirps[i].ID] {
+			if reaction.UserID == viewerID {
+				chirps[i].ViewerReactions = append(chirps[i].ViewerReactions, reaction.Emoji)
+			}
+		}
+		sort.Strings(chirps[i].ViewerReactions)
+	}
+}
+
+func setReaction(db *DB, chirpID, userID int, emoji string, reacted bool) (Chirp, error) {
+	chirp := Chirp{}
+	err := db.update(func(dbStructure *DBStructure) error {
+		found := false
+		chirp, found = dbStructure.Chirps[chirpID]
+		if !found || chirp.Hidden || !canViewChirp(*dbStructure, chirpViewer{ID: userID}, chirp, readDirect) {
+			return errors.New("Chirp not found")
+		}
+
+		existing := slices.IndexFunc(dbStructure.Reactions[chirpID], func(reaction Reaction) bool {
+			return reaction.UserID == userID && reaction.Emoji == emoji
+		})
+		reactions := dbStructure.Reactions[chirpID]
+		if existing >= 0 && !reacted {
+			reactions = slices.Delete(reactions, existing, existing+1)
+			dbStructure.removeNotifications(func(recipientID int, notification Notification) bool {
+				return notification.Type == notificationReaction && notification.ActorID == userID &&
+					notification.ChirpID == chirpID && notification.Emoji == emoji
+			})
+		}
+		if existing < 0 && reacted {
+			reactions = append(reactions, Reaction{
+				UserID:    userID,
+				Emoji:     emoji,
+				CreatedAt: time.Now().UTC(),
+			})
+			dbStructure.notify(chirp.AuthorID, Notification{
+				Type:    notificationReaction,
+				ActorID: userID,
+				ChirpID: chirpID,
+				Emoji:   emoji,
+			})
+		}
+		if len(reactions) == 0 {
+			delete(dbStructure.Reactions, chirpID)
+		} else {
+			dbStructure.Reactions[chirpID] = reactions
+		}
+		dbStructure.recountReactions(chirpID)
+
+		chirp = dbStructure.Chirps[chirpID]
+		chirps := []Chirp{chirp}
+		prepareChirps(*dbStructure, chirpViewer{ID: userID}, chirps)
+		chirp = chirps[0]
+		return nil
+	})
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	return chirp, nil
+}
+
+/*
+route: /api/chirps/{chirpID}/reactions/{emoji}
+method: PUT | DELETE
+
+emoji is one of like, heart, laugh, surprised, sad, angry (or the emoji
+itself). PUT adds the reaction and DELETE takes it back; both are idempotent.
+
+	req headers: {
+		Authorization string (jwtToken or access token with chirps:write)
+	}
+*/
+func (config *apiConfig) reactionHandler(w http.ResponseWriter, req *http.Request) {
+	id, err := config.authenticate(req, scopeChirpsWrite)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	chirpID, err := strconv.Atoi(req.PathValue("chirpID"))
+	if err != nil {
+		respondWithError(w, 400, "invalid chirp id")
+		return
+	}
+
+	emoji, err := reactionName(req.PathValue("emoji"))
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+
+	chirp, err := setReaction(config.db, chirpID, id, emoji, req.Method == http.MethodPut)
+	if err != nil {
+		if err.Error() == "Chirp not found" {
+			respondWithError(w, 404, err.Error())
+			return
+		}
+		respondWithError(w, 500, err.Error())
+		return
+	}
+
+	if req.Method == http.MethodDelete {
+		w.WriteHeader(204)
+		return
+	}
+	respondWithJSON(w, 200, chirp)
+}
+
+func reactionKey(reaction Reaction) pageCursor {
+	return pageCursor{CreatedAt: reaction.CreatedAt, ID: reaction.UserID}
+}
+
+/*
+route: /api/chirps/{chirpID}/reactions?emoji={optional}&limit={optional}&cursor={optional}
+method: GET
+
+Who reacted to the chirp, newest first.
+*/
+func (config *apiConfig) getReactionsHandler(w http.ResponseWriter, req *http.Request) {
+	chirpID, err := strconv.Atoi(req.PathValue("chirpID"))
+	if err != nil {
+		respondWithError(w, 400, "invalid chirp id")
+		return
+	}
+
+	emoji := ""
+	if emojiText := req.URL.Query().Get("emoji"); emojiText != "" {
+		emoji, err = reactionName(emojiText)
+		if err != nil {
+			respondWithError(w, 400, err.Error())
+			return
+		}
+	}
+
+	limit, cursor, err := pageRequest(req, "reactions")
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+
+	dbStructure, err := config.db.LoadDB()
+	if err != nil {
+		respondWithError(w, 500, err.Error())
+		return
+	}
+
+	chirp, found := dbStructure.Chirps[chirpID]
+	if !found || chirp.Hidden || !canViewChirp(dbStructure, config.optionalViewer(req), chirp, readDirect) {
+		respondWithError(w, 404, "Chirp not found")
+		return
+	}
+
+	reactions := []Reaction{}
+	for _, reaction := range dbStructure.Reactions[chirpID] {
+		if emoji == "" || reaction.Emoji == emoji {
+			reactions = append(reactions, reaction)
+		}
+	}
+	sort.Slice(reactions, func(i, j int) bool {
+		return byTimeDesc(reactionKey(reactions[i]), reactionKey(reactions[j]))
+	})
+
+	page, next, prev := paginate(reactions, reactionKey, byTimeDesc, limit, cursor)
+	nextCursor, prevCursor := pageLinks(w, req, "reactions", next, prev)
+
+	respondWithJSON(w, 200, struct {
+		Reactions  []Reaction `json:"reactions"`
+		NextCursor string     `json:"next_cursor,omitempty"`
+		PrevCursor string     `json:"prev_cursor,omitempty"`
+	}{
+		Reactions:  page,
+		NextCursor: nextCursor,
+		PrevCursor: prevCursor,
+	})
+}
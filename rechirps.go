@@ -0,0 +1,292 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+)
+
+// OriginalChirp is the chirp a rechirp or quote refers to, as rendered in
+// responses. Once the original is deleted or hidden, or whenever the viewer
+// can't see it, only its id is left and Unavailable is set.
+type OriginalChirp struct {
+	ID          int  `json:"id"`
+	Unavailable bool `json:"unavailable,omitempty"`
+	*Chirp
+}
+
+var (
+	errNotRechirped        = errors.New("you haven't rechirped this chirp")
+	errRechirpNotEditable  = errors.New("rechirps have no body to edit")
+	errQuotedChirpNotFound = errors.New("quoted_chirp_id does not refer to an existing chirp")
+)
+
+// originalID is the id of the chirp a rechirp or quote refers to, or 0.
+func originalID(chirp Chirp) int {
+	if chirp.RechirpOf != 0 {
+		return chirp.RechirpOf
+	}
+	return chirp.QuotedChirpID
+}
+
+/*
+prepareChirps fills in the fields of chirps that are never stored: the viewer's
+reactions, the author, attached media and the original of rechirps and quotes.
+Every handler runs chirps through it just before responding.
+*/
+func prepareChirps(dbStructure DBStructure, viewer chirpViewer, chirps []Chirp) {
+	viewerReactions(dbStructure, viewer.ID, chirps)
+	attachAuthors(dbStructure, chirps)
+	attachMediaResponses(dbStructure, chirps)
+	for i := range chirps {
+		id := originalID(chirps[i])
+		if id == 0 {
+			continue
+		}
+
+		original, found := dbStructure.Chirps[id]
+		if !found || original.Hidden || !canViewChirp(dbStructure, viewer, original, readDirect) {
+			chirps[i].Original = &OriginalChirp{ID: id, Unavailable: true}
+			continue
+		}
+		// originals are shown one level deep
+		originals := []Chirp{original}
+		viewerReactions(dbStructure, viewer.ID, originals)
+		attachAuthors(dbStructure, originals)
+		attachMediaResponses(dbStructure, originals)
+		chirps[i].Original = &OriginalChirp{ID: id, Chirp: &originals[0]}
+	}
+}
+
+// prepareChirpsFor is prepareChirps for handlers that don't already have the
+// database loaded.
+func (config *apiConfig) prepareChirpsFor(req *http.Request, chirps []Chirp) error {
+	if len(chirps) == 0 {
+		return nil
+	}
+	dbStructure, err := config.db.LoadDB()
+	if err != nil {
+		return err
+	}
+	prepareChirps(dbStructure, config.optionalViewer(req), chirps)
+	return nil
+}
+
+func (dbStructure *DBStructure) addShare(chirp Chirp) {
+	var index map[int][]int
+	switch {
+	case chirp.RechirpOf != 0:
+		index = dbStructure.Rechirps
+	case chirp.QuotedChirpID != 0:
+		index = dbStructure.Quotes
+	default:
+		return
+	}
+
+	id := originalID(chirp)
+	index[id] = append(index[id], chirp.ID)
+	dbStructure.recountShares(id)
+}
+
+func (dbStructure *DBStructure) removeShare(chirp Chirp) {
+	var index map[int][]int
+	switch {
+	case chirp.RechirpOf != 0:
+		index = dbStructure.Rechirps
+	case chirp.QuotedChirpID != 0:
+		index = dbStructure.Quotes
+	default:
+		return
+	}
+
+	id := originalID(chirp)
+	index[id] = slices.DeleteFunc(index[id], func(shareID int) bool {
+		return shareID == chirp.ID
+	})
+	if len(index[id]) == 0 {
+		delete(index, id)
+	}
+	dbStructure.recountShares(id)
+}
+
+func (dbStructure *DBStructure) recountShares(chirpID int) {
+	chirp, found := dbStructure.Chirps[chirpID]
+	if !found || chirp.Deleted {
+		return
+	}
+	chirp.RechirpCount = len(dbStructure.Rechirps[chirpID])
+	chirp.QuoteCount = len(dbStructure.Quotes[chirpID])
+	dbStructure.Chirps[chirpID] = chirp
+}
+
+// shareTarget resolves the chirp a new rechirp, quote or reply should point
+// at: sharing a rechirp shares what it rechirped.
+func shareTarget(dbStructure DBStructure, chirpID int) (Chirp, bool) {
+	chirp, found := dbStructure.Chirps[chirpID]
+	if found && chirp.RechirpOf != 0 {
+		chirp, found = dbStructure.Chirps[chirp.RechirpOf]
+	}
+	if !found || chirp.Deleted || chirp.Hidden {
+		return Chirp{}, false
+	}
+	return chirp, true
+}
+
+// rechirpInDB rechirps a chirp for the user. Rechirping twice is a no-op that
+// returns the existing rechirp; the bool reports whether one was created.
+func rechirpInDB(db *DB, userID, chirpID int) (Chirp, bool, error) {
+	rechirp := Chirp{}
+	created := false
+	err := db.update(func(dbStructure *DBStructure) error {
+		original, found := shareTarget(*dbStructure, chirpID)
+		if !found || !canViewChirp(*dbStructure, chirpViewer{ID: userID}, original, readDirect) {
+			return errors.New("Chirp not found")
+		}
+		if original.Visibility == visibilityFollowers {
+			return errNotRechirpable
+		}
+
+		for _, id := range dbStructure.Rechirps[original.ID] {
+			if dbStructure.Chirps[id].AuthorID == userID {
+				rechirp = dbStructure.Chirps[id]
+				return nil
+			}
+		}
+
+		var err error
+		rechirp, err = db.CreateChirp("", userID, 0)
+		if err != nil {
+			return err
+		}
+		rechirp.RechirpOf = original.ID
+		dbStructure.Chirps[rechirp.ID] = rechirp
+		dbStructure.LastChirpID = rechirp.ID
+		dbStructure.addToTimeline(rechirp)
+		dbStructure.addShare(rechirp)
+		dbStructure.notify(original.AuthorID, Notification{Type: notificationRechirp, ActorID: userID, ChirpID: rechirp.ID})
+		created = true
+		return nil
+	})
+	if err != nil {
+		return Chirp{}, false, err
+	}
+
+	return rechirp, created, nil
+}
+
+// undoRechirp deletes the user's rechirp of a chirp, which keeps working after
+// the original is gone.
+func undoRechirp(db *DB, userID, chirpID int) (int, error) {
+	rechirpID := 0
+	err := db.update(func(dbStructure *DBStructure) error {
+		if chirp, found := dbStructure.Chirps[chirpID]; found && chirp.RechirpOf != 0 {
+			chirpID = chirp.RechirpOf
+		}
+		for _, id := range dbStructure.Rechirps[chirpID] {
+			if dbStructure.Chirps[id].AuthorID == userID {
+				rechirpID = id
+			}
+		}
+		if rechirpID == 0 {
+			return errNotRechirped
+		}
+		dbStructure.removeChirp(rechirpID)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return rechirpID, nil
+}
+
+/*
+route: /api/chirps/{chirpID}/rechirp
+method: POST
+
+Responds 201 with the new rechirp, or 200 with the existing one if the chirp
+was already rechirped.
+
+	req headers: {
+		Authorization string (jwtToken or access token with chirps:write)
+	}
+*/
+func (config *apiConfig) rechirpHandler(w http.ResponseWriter, req *http.Request) {
+	id, err := config.authenticate(req, scopeChirpsWrite)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	chirpID, err := strconv.Atoi(req.PathValue("chirpID"))
+	if err != nil {
+		respondWithError(w, 400, "invalid chirp id")
+		return
+	}
+
+	rechirp, created, err := rechirpInDB(config.db, id, chirpID)
+	if err != nil {
+		if err.Error() == "Chirp not found" {
+			respondWithError(w, 404, err.Error())
+			return
+		}
+		if errors.Is(err, errNotRechirpable) {
+			respondWithError(w, 400, err.Error())
+			return
+		}
+		respondWithError(w, 500, err.Error())
+		return
+	}
+
+	statusCode := 200
+	if created {
+		config.fanOutChirp(rechirp)
+		statusCode = 201
+	}
+
+	chirps := []Chirp{rechirp}
+	err = config.prepareChirpsFor(req, chirps)
+	if err != nil {
+		respondWithError(w, 500, err.Error())
+		return
+	}
+
+	respondWithJSON(w, statusCode, chirps[0])
+}
+
+/*
+route: /api/chirps/{chirpID}/rechirp
+method: DELETE
+
+Undoes the user's rechirp of the chirp.
+
+	req headers: {
+		Authorization string (jwtToken or access token with chirps:write)
+	}
+*/
+func (config *apiConfig) undoRechirpHandler(w http.ResponseWriter, req *http.Request) {
+	id, err := config.authenticate(req, scopeChirpsWrite)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	chirpID, err := strconv.Atoi(req.PathValue("chirpID"))
+	if err != nil {
+		respondWithError(w, 400, "invalid chirp id")
+		return
+	}
+
+	_, err = undoRechirp(config.db, id, chirpID)
+	if err != nil {
+		if errors.Is(err, errNotRechirped) {
+			respondWithError(w, 404, err.Error())
+			return
+		}
+		respondWithError(w, 500, err.Error())
+		return
+	}
+
+	w.WriteHeader(204)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+)
+
+const (
+	roleUser      = "user"
+	roleModerator = "moderator"
+	roleAdmin     = "admin"
+)
+
+const (
+	permDeleteAnyChirp = "chirps:delete_any"
+	permHideChirps     = "chirps:hide"
+	permManageUsers    = "users:manage"
+	permAccessAdmin    = "admin:access"
+)
+
+var rolePermissions = map[string][]string{
+	roleUser:      {},
+	roleModerator: {permHideChirps},
+	roleAdmin:     {permDeleteAnyChirp, permHideChirps, permManageUsers, permAccessAdmin},
+}
+
+type contextKey string
+
+const userIDContextKey contextKey = "userID"
+
+// userRole treats users created before roles existed as regular users.
+func userRole(user User) string {
+	if user.Role == "" {
+		return roleUser
+	}
+	return user.Role
+}
+
+func hasPermission(user User, permission string) bool {
+	return slices.Contains(rolePermissions[userRole(user)], permission)
+}
+
+func findUserById(db *DB, id int) (User, error) {
+	dbStructure, err := db.LoadDB()
+	if err != nil {
+		return User{}, err
+	}
+
+	user, found := dbStructure.Users[id]
+	if !found {
+		return User{}, errors.New("user not found")
+	}
+
+	return user, nil
+}
+
+func userIDFromContext(req *http.Request) int {
+	id, _ := req.Context().Value(userIDContextKey).(int)
+	return id
+}
+
+// optionalViewer returns the user making the request, with ID 0 for
+// anonymous requests and invalid credentials.
+func (config *apiConfig) optionalViewer(req *http.Request) chirpViewer {
+	if req.Header.Get("Authorization") == "" {
+		return chirpViewer{}
+	}
+	id, scopes, err := config.authenticateWithScopes(req, scopeChirpsRead)
+	if err != nil {
+		return chirpViewer{}
+	}
+	return chirpViewer{ID: id, Scopes: scopes}
+}
+
+func setChirpHidden(db *DB, actorID, chirpID int, hidden bool) (Chirp, error) {
+	chirp := Chirp{}
+	err := db.update(func(dbStructure *DBStructure) error {
+		found := false
+		chirp, found = dbStructure.Chirps[chirpID]
+		if !found || chirp.Deleted {
+			return errors.New("Chirp not found")
+		}
+		chirp.Hidden = hidden
+		dbStructure.Chirps[chirpID] = chirp
+
+		action := "chirp.unhide"
+		if hidden {
+			action = "chirp.hide"
+		}
+		appendAuditEntry(dbStructure, actorID, action, chirp.AuthorID, "chirp "+strconv.Itoa(chirpID))
+		return nil
+	})
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	return chirp, nil
+}
+
+/*
+promoteFirstAdmin backs the `promote-admin <email>` bootstrap command. It
+refuses to run once any admin exists; after that, admins manage roles through
+the API.
+*/
+func promoteFirstAdmin(db *DB, email string) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		for _, user := range dbStructure.Users {
+			if userRole(user) == roleAdmin {
+				return fmt.Errorf("an admin already exists (%s)", user.Email)
+			}
+		}
+
+		for id, user := range dbStructure.Users {
+			if user.Email == email {
+				user.Role = roleAdmin
+				dbStructure.Users[id] = user
+				return nil
+			}
+		}
+		return errors.New("user not found")
+	})
+}
+
+/*
+route: /admin/api/users/{userID}/role
+method: PUT
+
+	req body shape: {
+		role "user" | "moderator" | "admin"
+	}
+
+	req headers: {
+		Authorization string (jwtToken, admin)
+	}
+*/
+func (config *apiConfig) setUserRoleHandler(w http.ResponseWriter, req *http.Request) {
+	userID, ok := pathUserID(w, req)
+	if !ok {
+		return
+	}
+
+	params, err := decodeJSON(req)
+	if err != nil {
+		respondWithError(w, 500, "error decoding request body")
+		return
+	}
+
+	_, known := rolePermissions[params.Role]
+	if !known {
+		respondWithError(w, 400, "unknown role")
+		return
+	}
+
+	// keep at least one way back into the admin routes
+	if userID == userIDFromContext(req) && params.Role != roleAdmin {
+		respondWithError(w, 400, "admins cannot demote themselves")
+		return
+	}
+
+	user, err := updateUserAsAdmin(config.db, userIDFromContext(req), userID, "user.role", params.Role, func(user *User) error {
+		user.Role = params.Role
+		return nil
+	})
+	if err != nil {
+		if err.Error() == "user not found" {
+			respondWithError(w, 404, err.Error())
+			return
+		}
+		respondWithError(w, 500, err.Error())
+		return
+	}
+
+	respondWithJSON(w, 200, struct {
+		ID    int    `json:"id"`
+		Email string `json:"email"`
+		Role  string `json:"role"`
+	}{
+		ID:    user.ID,
+		Email: user.Email,
+		Role:  userRole(user),
+	})
+}
+
+/*
+route: /api/chirps/{chirpID}/hidden
+method: PUT (hide) | DELETE (unhide)
+
+	req headers: {
+		Authorization string (jwtToken, moderator or admin)
+	}
+*/
+func (config *apiConfig) hideChirpHandler(w http.ResponseWriter, req *http.Request) {
+	chirpID, err := strconv.Atoi(req.PathValue("chirpID"))
+	if err != nil {
+		respondWithError(w, 400, "invalid chirp id")
+		return
+	}
+
+	chirp, err := setChirpHidden(config.db, userIDFromContext(req), chirpID, req.Method == http.MethodPut)
+	if err != nil {
+		if err.Error() == "Chirp not found" {
+			respondWithError(w, 404, err.Error())
+			return
+		}
+		respondWithError(w, 500, err.Error())
+		return
+	}
+	if chirp.Hidden {
+		config.search.Remove(chirp.ID)
+	} else {
+		config.search.Add(chirp)
+	}
+
+	w.WriteHeader(204)
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"html"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+/*
+searchIndex is an in-process inverted index over chirp bodies. It is rebuilt
+from the database on startup and kept current as chirps are created, hidden
+and deleted; the database stays the source of truth, so results are always
+re-read from it before being returned.
+*/
+type searchIndex struct {
+	mux sync.RWMutex
+	// term -> chirp id -> token positions of the term in the chirp
+	postings    map[string]map[int][]int
+	docs        map[int]searchDoc
+	totalLength int
+}
+
+type searchDoc struct {
+	AuthorID  int
+	CreatedAt time.Time
+	Length    int
+	Terms     []string
+}
+
+type searchToken struct {
+	Term  string
+	Start int
+	End   int
+}
+
+type searchQuery struct {
+	Terms    []string
+	Phrases  [][]string
+	AuthorID int
+	Since    time.Time
+	Until    time.Time
+}
+
+type searchHit struct {
+	ChirpID int
+	Score   float64
+}
+
+// BM25 tuning constants, the usual defaults
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+
+	snippetRadius = 60
+)
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		postings: make(map[string]map[int][]int),
+		docs:     make(map[int]searchDoc),
+	}
+}
+
+// tokenize splits text into case-folded runs of letters and digits, keeping
+// the byte offsets of each token so matches can be highlighted.
+func tokenize(text string) []searchToken {
+	tokens := []searchToken{}
+	start := -1
+	for i, r := range text {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 {
+			tokens = append(tokens, searchToken{Term: strings.ToLower(text[start:i]), Start: start, End: i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, searchToken{Term: strings.ToLower(text[start:]), Start: start, End: len(text)})
+	}
+	return tokens
+}
+
+// parseSearchQuery treats "double quoted" parts as phrases and everything
+// else as individual terms. Every term and phrase must match.
+func parseSearchQuery(q string) searchQuery {
+	query := searchQuery{}
+	parts := strings.Split(q, `"`)
+	for i, part := range parts {
+		terms := []string{}
+		for _, token := range tokenize(part) {
+			terms = append(terms, token.Term)
+		}
+		// odd parts sit between a pair of quotes
+		if i%2 == 1 && len(terms) > 1 {
+			query.Phrases = append(query.Phrases, terms)
+			continue
+		}
+		query.Terms = append(query.Terms, terms...)
+	}
+	return query
+}
+
+func (index *searchIndex) Build(chirps map[int]Chirp) {
+	index.mux.Lock()
+	defer index.mux.Unlock()
+
+	index.postings = make(map[string]map[int][]int)
+	index.docs = make(map[int]searchDoc)
+	index.totalLength = 0
+	for _, chirp := range chirps {
+		index.add(chirp)
+	}
+}
+
+func (config *apiConfig) rebuildSearchIndex() {
+	dbStructure, err := config.db.LoadDB()
+	if err != nil {
+		log.Printf("could not rebuild search index: %v", err)
+		return
+	}
+	config.search.Build(dbStructure.Chirps)
+}
+
+func (index *searchIndex) Add(chirp Chirp) {
+	index.mux.Lock()
+	defer index.mux.Unlock()
+
+	index.remove(chirp.ID)
+	index.add(chirp)
+}
+
+func (index *searchIndex) Remove(chirpID int) {
+	index.mux.Lock()
+	defer index.mux.Unlock()
+
+	index.remove(chirpID)
+}
+
+func (index *searchIndex) add(chirp Chirp) {
+	if chirp.Hidden || chirp.Deleted || chirp.RechirpOf != 0 {
+		return
+	}
+
+	tokens := tokenize(chirp.Body)
+	doc := searchDoc{
+		AuthorID:  chirp.AuthorID,
+		CreatedAt: chirp.CreatedAt,
+		Length:    len(tokens),
+	}
+	for position, token := range tokens {
+		if index.postings[token.Term] == nil {
+			index.postings[token.Term] = make(map[int][]int)
+		}
+		if len(index.postings[token.Term][chirp.ID]) == 0 {
+			doc.Terms = append(doc.Terms, token.Term)
+		}
+		index.postings[token.Term][chirp.ID] = append(index.postings[token.Term][chirp.ID], position)
+	}
+
+	index.docs[chirp.ID] = doc
+	index.totalLength += doc.Length
+}
+
+func (index *searchIndex) remove(chirpID int) {
+	doc, found := index.docs[chirpID]
+	if !found {
+		return
+	}
+
+	for _, term := range doc.Terms {
+		delete(index.postings[term], chirpID)
+		if len(index.postings[term]) == 0 {
+			delete(index.postings, term)
+		}
+	}
+	delete(index.docs, chirpID)
+	index.totalLength -= doc.Length
+}
+
+// Search returns matching chirp ids ordered by BM25 score, best first.
+func (index *searchIndex) Search(query searchQuery) []searchHit {
+	index.mux.RLock()
+	defer index.mux.RUnlock()
+
+	terms := append([]string{}, query.Terms...)
+	for _, phrase := range query.Phrases {
+		terms = append(terms, phrase...)
+	}
+	// a repeated term counts once
+	slices.Sort(terms)
+	terms = slices.Compact(terms)
+	if len(terms) == 0 || len(index.docs) == 0 {
+		return []searchHit{}
+	}
+
+	// start from the rarest term so the intersection stays small
+	sort.Slice(terms, func(i, j int) bool { return len(index.postings[terms[i]]) < len(index.postings[terms[j]]) })
+	candidates := []int{}
+	for chirpID := range index.postings[terms[0]] {
+		candidates = append(candidates, chirpID)
+	}
+
+	avgLength := float64(index.totalLength) / float64(len(index.docs))
+	hits := []searchHit{}
+	for _, chirpID := range candidates {
+		doc := index.docs[chirpID]
+		if !index.matches(chirpID, doc, terms, query) {
+			continue
+		}
+
+		score := 0.0
+		for _, term := range terms {
+			df := float64(len(index.postings[term]))
+			tf := float64(len(index.postings[term][chirpID]))
+			idf := math.Log(1 + (float64(len(index.docs))-df+0.5)/(df+0.5))
+			score += idf * tf * (bm25K1 + 1) / (tf + bm25K1*(1-bm25B+bm25B*float64(doc.Length)/avgLength))
+		}
+		hits = append(hits, searchHit{ChirpID: chirpID, Score: score})
+	}
+
+	sort.Slice(hits, func(i, j int) bool {
+		return byScoreDesc(pageCursor{Score: hits[i].Score, ID: hits[i].ChirpID}, pageCursor{Score: hits[j].Score, ID: hits[j].ChirpID})
+	})
+	return hits
+}
+
+func (index *searchIndex) matches(chirpID int, doc searchDoc, terms []string, query searchQuery) bool {
+	if query.AuthorID != 0 && doc.AuthorID != query.AuthorID {
+		return false
+	}
+	if !query.Since.IsZero() && doc.CreatedAt.Before(query.Since) {
+		return false
+	}
+	if !query.Until.IsZero() && !doc.CreatedAt.Before(query.Until) {
+		return false
+	}
+
+	for _, term := range terms {
+		if len(index.postings[term][chirpID]) == 0 {
+			return false
+		}
+	}
+
+	for _, phrase := range query.Phrases {
+		if !index.containsPhrase(chirpID, phrase) {
+			return false
+		}
+	}
+	return true
+}
+
+func (index *searchIndex) containsPhrase(chirpID int, phrase []string) bool {
+	for _, start := range index.postings[phrase[0]][chirpID] {
+		found := true
+		for offset, term := range phrase[1:] {
+			positions := index.postings[term][chirpID]
+			i := sort.SearchInts(positions, start+offset+1)
+			if i == len(positions) || positions[i] != start+offset+1 {
+				found = false
+				break
+			}
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+highlightSnippet returns an HTML-escaped excerpt of body around the first
+match with every matching term wrapped in <mark> tags.
+*/
+func highlightSnippet(body string, query searchQuery) string {
+	wanted := make(map[string]bool)
+	for _, term := range query.Terms {
+		wanted[term] = true
+	}
+	for _, phrase := range query.Phrases {
+		for _, term := range phrase {
+			wanted[term] = true
+		}
+	}
+
+	matches := []searchToken{}
+	for _, token := range tokenize(body) {
+		if wanted[token.Term] {
+			matches = append(matches, token)
+		}
+	}
+	if len(matches) == 0 {
+		return html.EscapeString(body)
+	}
+
+	start := max(0, matches[0].Start-snippetRadius)
+	end := min(len(body), matches[0].End+snippetRadius*2)
+	// don't cut a multi-byte character in half
+	for start > 0 && !utf8.RuneStart(body[start]) {
+		start--
+	}
+	for end < len(body) && !utf8.RuneStart(body[end]) {
+		end++
+	}
+
+	snippet := strings.Builder{}
+	if start > 0 {
+		snippet.WriteString("…")
+	}
+	position := start
+	for _, match := range matches {
+		if match.Start < start || match.End > end {
+			continue
+		}
+		snippet.WriteString(html.EscapeString(body[position:match.Start]))
+		snippet.WriteString("<mark>")
+		snippet.WriteString(html.EscapeString(body[match.Start:match.End]))
+		snippet.WriteString("</mark>")
+		position = match.End
+	}
+	snippet.WriteString(html.EscapeString(body[position:end]))
+	if end < len(body) {
+		snippet.WriteString("…")
+	}
+
+	return snippet.String()
+}
+
+type searchResult struct {
+	Chirp   Chirp   `json:"chirp"`
+	Score   float64 `json:"score"`
+	Snippet string  `json:"snippet"`
+}
+
+func searchHitKey(hit searchHit) pageCursor {
+	return pageCursor{Score: hit.Score, ID: hit.ChirpID}
+}
+
+/*
+route: /api/chirps/search?q=&author_id={optional}&since={RFC3339, optional}&until={RFC3339, optional}&limit={optional}&cursor={optional}
+method: GET
+
+Wrap words in double quotes to search for an exact phrase. Results are ordered
+by relevance, ties broken by id. Scores shift as chirps are posted and
+deleted, so paging while the index changes can skip or repeat a result.
+*/
+func (config *apiConfig) searchChirpsHandler(w http.ResponseWriter, req *http.Request) {
+	query := parseSearchQuery(req.URL.Query().Get("q"))
+	if len(query.Terms) == 0 && len(query.Phrases) == 0 {
+		respondWithError(w, 400, "q is required")
+		return
+	}
+
+	query.AuthorID, _ = strconv.Atoi(req.URL.Query().Get("author_id"))
+	var err error
+	if since := req.URL.Query().Get("since"); since != "" {
+		query.Since, err = time.Parse(time.RFC3339, since)
+		if err != nil {
+			respondWithError(w, 400, "since must be an RFC 3339 timestamp")
+			return
+		}
+	}
+	if until := req.URL.Query().Get("until"); until != "" {
+		query.Until, err = time.Parse(time.RFC3339, until)
+		if err != nil {
+			respondWithError(w, 400, "until must be an RFC 3339 timestamp")
+			return
+		}
+	}
+
+	limit, cursor, err := pageRequest(req, "relevance")
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+
+	dbStructure, err := config.db.LoadDB()
+	if err != nil {
+		respondWithError(w, 500, err.Error())
+		return
+	}
+
+	viewer := config.optionalViewer(req)
+	hits := slices.DeleteFunc(config.search.Search(query), func(hit searchHit) bool {
+		chirp, found := dbStructure.Chirps[hit.ChirpID]
+		return !found || !canViewChirp(dbStructure, viewer, chirp, readPublicListing)
+	})
+	page, next, prev := paginate(hits, searchHitKey, byScoreDesc, limit, cursor)
+	nextCursor, prevCursor := pageLinks(w, req, "relevance", next, prev)
+
+	chirps := make([]Chirp, 0, len(page))
+	for _, hit := range page {
+		chirps = append(chirps, dbStructure.Chirps[hit.ChirpID])
+	}
+	prepareChirps(dbStructure, viewer, chirps)
+	results := make([]searchResult, 0, len(page))
+	for i, hit := range page {
+		results = append(results, searchResult{
+			Chirp:   chirps[i],
+			Score:   hit.Score,
+			Snippet: highlightSnippet(chirps[i].Body, query),
+		})
+	}
+
+	respondWithJSON(w, 200, struct {
+		Results    []searchResult `json:"results"`
+		NextCursor string         `json:"next_cursor,omitempty"`
+		PrevCursor string         `json:"prev_cursor,omitempty"`
+	}{
+		Results:    results,
+		NextCursor: nextCursor,
+		PrevCursor: prevCursor,
+	})
+}
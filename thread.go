@@ -0,0 +1,212 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// threadNode is a chirp in a thread together with the replies loaded below it.
+type threadNode struct {
+	Chirp
+	Replies []threadNode `json:"replies,omitempty"`
+}
+
+const (
+	defaultThreadDepth = 3
+	maxThreadDepth     = 10
+	// replies shown under each nested chirp; the rest are a thread request
+	// for that chirp away
+	threadPreviewReplies = 3
+)
+
+var errParentNotFound = errors.New("in_reply_to does not refer to an existing chirp")
+
+func (dbStructure *DBStructure) addReply(chirp Chirp) {
+	if chirp.InReplyTo == 0 {
+		return
+	}
+	parent := dbStructure.Chirps[chirp.InReplyTo]
+	dbStructure.ChirpReplies[parent.ID] = append(dbStructure.ChirpReplies[parent.ID], chirp.ID)
+	parent.ReplyCount = len(dbStructure.ChirpReplies[parent.ID])
+	dbStructure.Chirps[parent.ID] = parent
+}
+
+/*
+removeChirp deletes a chirp. A chirp that still has replies is replaced by a
+tombstone instead so its thread stays connected, and a tombstone is dropped
+as soon as its last reply goes.
+*/
+func (dbStructure *DBStructure) removeChirp(chirpID int) {
+	chirp, found := dbStructure.Chirps[chirpID]
+	if !found {
+		return
+	}
+	dbStructure.removeFromTimeline(chirpID)
+	dbStructure.unindexHashtags(chirp)
+	delete(dbStructure.ChirpRevisions, chirpID)
+	delete(dbStructure.Reactions, chirpID)
+	dbStructure.removeNotifications(func(userID int, notification Notification) bool {
+		return notification.ChirpID == chirpID
+	})
+	dbStructure.removeShare(chirp)
+	for _, mediaID := range chirp.MediaIDs {
+		dbStructure.removeMedia(mediaID)
+	}
+
+	if len(dbStructure.ChirpReplies[chirpID]) > 0 {
+		dbStructure.Chirps[chirpID] = Chirp{
+			ID:         chirp.ID,
+			CreatedAt:  chirp.CreatedAt,
+			UpdatedAt:  time.Now().UTC(),
+			InReplyTo:  chirp.InReplyTo,
+			ReplyCount: chirp.ReplyCount,
+			Deleted:    true,
+		}
+		return
+	}
+
+	delete(dbStructure.Chirps, chirpID)
+	delete(dbStructure.ChirpReplies, chirpID)
+	if chirp.InReplyTo == 0 {
+		return
+	}
+
+	parent, found := dbStructure.Chirps[chirp.InReplyTo]
+	if !found {
+		return
+	}
+	dbStructure.ChirpReplies[parent.ID] = slices.DeleteFunc(dbStructure.ChirpReplies[parent.ID], func(id int) bool {
+		return id == chirpID
+	})
+	parent.ReplyCount = len(dbStructure.ChirpReplies[parent.ID])
+	dbStructure.Chirps[parent.ID] = parent
+	if parent.Deleted && parent.ReplyCount == 0 {
+		dbStructure.removeChirp(parent.ID)
+	}
+}
+
+// threadView blanks out chirps the viewer isn't allowed to read while keeping
+// their place in the thread. Tombstones are shown as they are.
+func threadView(dbStructure DBStructure, chirp Chirp, viewer chirpViewer) Chirp {
+	if !chirp.Deleted && !canViewChirp(dbStructure, viewer, chirp, readDirect) {
+		return Chirp{
+			ID:          chirp.ID,
+			CreatedAt:   chirp.CreatedAt,
+			InReplyTo:   chirp.InReplyTo,
+			ReplyCount:  chirp.ReplyCount,
+			Unavailable: true,
+		}
+	}
+	chirps := []Chirp{chirp}
+	prepareChirps(dbStructure, viewer, chirps)
+	return chirps[0]
+}
+
+// repliesTo returns the direct replies of a chirp, oldest first.
+func repliesTo(dbStructure DBStructure, chirpID int) []Chirp {
+	replies := []Chirp{}
+	for _, replyID := range dbStructure.ChirpReplies[chirpID] {
+		replies = append(replies, dbStructure.Chirps[replyID])
+	}
+	slices.SortFunc(replies, func(a, b Chirp) int {
+		if chirpBefore(a, b) {
+			return -1
+		}
+		return 1
+	})
+	return replies
+}
+
+func buildThreadNode(dbStructure DBStructure, chirp Chirp, depth int, viewer chirpViewer) threadNode {
+	node := threadNode{Chirp: threadView(dbStructure, chirp, viewer)}
+	if depth <= 0 {
+		return node
+	}
+
+	replies := repliesTo(dbStructure, chirp.ID)
+	for _, reply := range replies[:min(len(replies), threadPreviewReplies)] {
+		node.Replies = append(node.Replies, buildThreadNode(dbStructure, reply, depth-1, viewer))
+	}
+	return node
+}
+
+/*
+route: /api/chirps/{chirpID}/thread?depth={optional}&limit={optional}&cursor={optional}
+method: GET
+
+Returns the chain of chirps the chirp replies to (root first) and its direct
+replies, oldest first and paged. depth counts the levels of replies loaded,
+starting with the direct ones. Deleted chirps that still have replies show up
+as tombstones, and chirps the viewer can't see are marked unavailable.
+*/
+func (config *apiConfig) getThreadHandler(w http.ResponseWriter, req *http.Request) {
+	chirpID, err := strconv.Atoi(req.PathValue("chirpID"))
+	if err != nil {
+		respondWithError(w, 400, "invalid chirp id")
+		return
+	}
+
+	depth := defaultThreadDepth
+	if depthText := req.URL.Query().Get("depth"); depthText != "" {
+		depth, err = strconv.Atoi(depthText)
+		if err != nil || depth <= 0 {
+			respondWithError(w, 400, "depth must be a positive integer")
+			return
+		}
+		depth = min(depth, maxThreadDepth)
+	}
+
+	limit, cursor, err := pageRequest(req, chirpSortCreatedAt)
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+
+	dbStructure, err := config.db.LoadDB()
+	if err != nil {
+		respondWithError(w, 500, err.Error())
+		return
+	}
+
+	viewer := config.optionalViewer(req)
+	chirp, found := dbStructure.Chirps[chirpID]
+	if !found || (!chirp.Deleted && !canViewChirp(dbStructure, viewer, chirp, readDirect)) {
+		respondWithError(w, 404, "Chirp not found")
+		return
+	}
+
+	ancestors := []Chirp{}
+	for parentID := chirp.InReplyTo; parentID != 0; {
+		parent, found := dbStructure.Chirps[parentID]
+		if !found {
+			break
+		}
+		ancestors = append(ancestors, threadView(dbStructure, parent, viewer))
+		parentID = parent.InReplyTo
+	}
+	slices.Reverse(ancestors)
+
+	page, next, prev := paginate(repliesTo(dbStructure, chirpID), chirpKey, byTimeAsc, limit, cursor)
+	replies := []threadNode{}
+	for _, reply := range page {
+		replies = append(replies, buildThreadNode(dbStructure, reply, depth-1, viewer))
+	}
+	nextCursor, prevCursor := pageLinks(w, req, chirpSortCreatedAt, next, prev)
+
+	respondWithJSON(w, 200, struct {
+		Ancestors  []Chirp      `json:"ancestors"`
+		Chirp      Chirp        `json:"chirp"`
+		Replies    []threadNode `json:"replies"`
+		NextCursor string       `json:"next_cursor,omitempty"`
+		PrevCursor string       `json:"prev_cursor,omitempty"`
+	}{
+		Ancestors:  ancestors,
+		Chirp:      threadView(dbStructure, chirp, viewer),
+		Replies:    replies,
+		NextCursor: nextCursor,
+		PrevCursor: prevCursor,
+	})
+}
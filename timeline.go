@@ -0,0 +1,198 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+)
+
+/*
+timelineCache holds the newest chirps of each active user's home timeline
+(their own chirps and those of everyone they follow), newest first. New chirps
+are pushed into the cached timelines of the author's followers as they're
+written, so reading a home timeline doesn't scan the database. Timelines are
+built on first read and dropped whenever the user's follows change; entries
+for chirps that are later deleted or hidden, or that blocks and mutes keep from
+the user, are filtered out on read.
+*/
+type timelineCache struct {
+	mux       sync.Mutex
+	timelines map[int][]pageCursor
+	maxLength int
+}
+
+func newTimelineCache(maxLength int) *timelineCache {
+	return &timelineCache{
+		timelines: make(map[int][]pageCursor),
+		maxLength: maxLength,
+	}
+}
+
+// homeTimelineAuthors is the set of authors whose chirps appear on the user's
+// home timeline.
+func homeTimelineAuthors(dbStructure DBStructure, userID int) map[int]bool {
+	authors := map[int]bool{userID: true}
+	for _, follow := range dbStructure.Following[userID] {
+		authors[follow.UserID] = true
+	}
+	return authors
+}
+
+// scanHomeTimeline walks the chirp timeline from the newest end and returns
+// up to limit entries of the user's home timeline; limit 0 means all of them.
+func scanHomeTimeline(dbStructure DBStructure, userID, limit int) []pageCursor {
+	authors := homeTimelineAuthors(dbStructure, userID)
+	entries := []pageCursor{}
+	for i := len(dbStructure.ChirpTimeline) - 1; i >= 0; i-- {
+		chirp := dbStructure.Chirps[dbStructure.ChirpTimeline[i]]
+		if !authors[chirp.AuthorID] {
+			continue
+		}
+		entries = append(entries, chirpKey(chirp))
+		if limit > 0 && len(entries) == limit {
+			break
+		}
+	}
+	return entries
+}
+
+// Get returns the cached timeline of the user, building it from the database
+// on a miss.
+func (cache *timelineCache) Get(db *DB, userID int) ([]pageCursor, error) {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+
+	if entries, found := cache.timelines[userID]; found {
+		return slices.Clone(entries), nil
+	}
+
+	// built while holding the lock so a chirp written during the scan is
+	// either in the scan or pushed after it
+	dbStructure, err := db.LoadDB()
+	if err != nil {
+		return nil, err
+	}
+	entries := scanHomeTimeline(dbStructure, userID, cache.maxLength)
+	cache.timelines[userID] = entries
+	return slices.Clone(entries), nil
+}
+
+// Push fans a new chirp out to the cached timelines of the given users.
+func (cache *timelineCache) Push(chirp Chirp, userIDs []int) {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+
+	key := chirpKey(chirp)
+	for _, userID := range userIDs {
+		entries, found := cache.timelines[userID]
+		if !found {
+			continue
+		}
+		i := sort.Search(len(entries), func(i int) bool { return !byTimeDesc(entries[i], key) })
+		if i < len(entries) && entries[i].ID == chirp.ID {
+			continue
+		}
+		entries = slices.Insert(entries, i, key)
+		if len(entries) > cache.maxLength {
+			entries = entries[:cache.maxLength]
+		}
+		cache.timelines[userID] = entries
+	}
+}
+
+func (cache *timelineCache) Invalidate(userID int) {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+
+	delete(cache.timelines, userID)
+}
+
+func (cache *timelineCache) Clear() {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+
+	cache.timelines = make(map[int][]pageCursor)
+}
+
+// fanOutChirp pushes a freshly written chirp to its author's followers.
+func (config *apiConfig) fanOutChirp(chirp Chirp) {
+	dbStructure, err := config.db.LoadDB()
+	if err != nil {
+		log.Printf("could not fan out chirp %d: %v", chirp.ID, err)
+		return
+	}
+
+	recipients := []int{chirp.AuthorID}
+	for _, follow := range dbStructure.Followers[chirp.AuthorID] {
+		recipients = append(recipients, follow.UserID)
+	}
+	config.timelines.Push(chirp, recipients)
+}
+
+/*
+route: /api/timeline/home?limit={optional}&cursor={optional}
+method: GET
+
+Chirps by the user and everyone they follow, newest first, leaving out users
+they muted or blocked or who blocked them.
+
+	req headers: {
+		Authorization string (jwtToken or access token with chirps:read)
+	}
+*/
+func (config *apiConfig) homeTimelineHandler(w http.ResponseWriter, req *http.Request) {
+	id, scopes, err := config.authenticateWithScopes(req, scopeChirpsRead)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+	viewer := chirpViewer{ID: id, Scopes: scopes}
+
+	limit, cursor, err := pageRequest(req, chirpSortCreatedAtDesc)
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+
+	entries, err := config.timelines.Get(config.db, id)
+	if err != nil {
+		respondWithError(w, 500, err.Error())
+		return
+	}
+
+	dbStructure, err := config.db.LoadDB()
+	if err != nil {
+		respondWithError(w, 500, err.Error())
+		return
+	}
+
+	chirpsFrom := func(entries []pageCursor) []Chirp {
+		chirps := []Chirp{}
+		for _, entry := range entries {
+			chirp, found := dbStructure.Chirps[entry.ID]
+			if !found || !canViewChirp(dbStructure, viewer, chirp, readHomeTimeline) {
+				continue
+			}
+			chirps = append(chirps, chirp)
+		}
+		return chirps
+	}
+
+	chirps := chirpsFrom(entries)
+	page, next, prev := paginate(chirps, chirpKey, byTimeDesc, limit, cursor)
+	// the cache only keeps the newest chirps; older pages come from a scan
+	if next == nil && len(entries) == config.timelines.maxLength {
+		chirps = chirpsFrom(scanHomeTimeline(dbStructure, id, 0))
+		page, next, prev = paginate(chirps, chirpKey, byTimeDesc, limit, cursor)
+	}
+	prepareChirps(dbStructure, viewer, page)
+	nextCursor, prevCursor := pageLinks(w, req, chirpSortCreatedAtDesc, next, prev)
+
+	respondWithJSON(w, 200, chirpPage{
+		Chirps:     page,
+		NextCursor: nextCursor,
+		PrevCursor: prevCursor,
+	})
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type AccessToken struct {
+	ID        int        `json:"id"`
+	UserID    int        `json:"user_id"`
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	TokenHash string     `json:"token_hash"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+const (
+	// public chirps can be read without any credentials, so chirps:read
+	// only gates what's private to the user: the home timeline, bookmarks
+	// and notifications. On public routes a token without it is treated as
+	// anonymous, so followers-only chirps stay out of reach.
+	scopeChirpsRead  = "chirps:read"
+	scopeChirpsWrite = "chirps:write"
+	scopeUsersWrite  = "users:write"
+	// direct messages are kept apart from chirps, so chirp scopes don't
+	// reach them
+	scopeMessagesRead  = "messages:read"
+	scopeMessagesWrite = "messages:write"
+	// lets a delegated token act with the user's role, e.g. an admin
+	// deleting other users' chirps; session JWTs always can. Only personal
+	// access tokens can carry it, never OAuth grants.
+	scopeAdmin = "admin"
+
+	accessTokenPrefix = "chirpy_pat_"
+)
+
+var validScopes = []string{scopeChirpsRead, scopeChirpsWrite, scopeUsersWrite, scopeMessagesRead, scopeMessagesWrite, scopeAdmin}
+
+var (
+	errInvalidCredentials = errors.New("invalid or expired credentials")
+	errInsufficientScope  = errors.New("token does not grant the required scope")
+)
+
+/*
+authenticate resolves the user behind the request's bearer credential, which
+may be a session JWT, an OAuth access token or a personal access token, and
+checks that it grants scope. Session JWTs act with the user's full authority.
+*/
+func (config *apiConfig) authenticate(req *http.Request, scope string) (int, error) {
+	id, _, err := config.authenticateWithScopes(req, scope)
+	return id, err
+}
+
+// authenticateWithScopes is authenticate that also returns every scope the
+// credential grants, or nil for session JWTs.
+func (config *apiConfig) authenticateWithScopes(req *http.Request, scope string) (int, []string, error) {
+	bearer := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+
+	id := 0
+	scopes := []string(nil)
+	if !strings.HasPrefix(bearer, accessTokenPrefix) {
+		jwtID, jwtScopes, err := validateScopedToken(bearer)
+		if err != nil {
+			return 0, nil, err
+		}
+		if jwtScopes != nil && !slices.Contains(jwtScopes, scope) {
+			return 0, nil, errInsufficientScope
+		}
+		id, scopes = jwtID, jwtScopes
+	} else {
+		token, err := findAccessToken(config.db, bearer)
+		if err != nil {
+			return 0, nil, err
+		}
+		if !slices.Contains(token.Scopes, scope) {
+			return 0, nil, errInsufficientScope
+		}
+		id, scopes = token.UserID, token.Scopes
+	}
+
+	_, err := config.activeUser(id)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return id, scopes, nil
+}
+
+// authenticateSession is authenticate for routes that only take a session
+// JWT, such as minting access tokens or scheduling account deletion.
+func (config *apiConfig) authenticateSession(req *http.Request) (int, error) {
+	id, err := validateToken(strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "))
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = config.activeUser(id)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// activeUser looks up the user behind a credential, refusing users who are
+// suspended or have to reset their password.
+func (config *apiConfig) activeUser(id int) (User, error) {
+	user, err := findUserById(config.db, id)
+	if err != nil {
+		return User{}, errInvalidCredentials
+	}
+	if user.SuspendedAt != nil {
+		return User{}, errAccountSuspended
+	}
+	// a forced reset signs the user out, including session JWTs that
+	// haven't expired yet
+	if user.PasswordResetRequired {
+		return User{}, errPasswordResetRequired
+	}
+	return user, nil
+}
+
+// rolesApply reports whether a credential granting scopes (nil for session
+// JWTs) may use the user's role permissions. Delegated tokens need the admin
+// scope, so a token handed out for posting can't be used to moderate.
+func rolesApply(scopes []string) bool {
+	return scopes == nil || slices.Contains(scopes, scopeAdmin)
+}
+
+func respondWithAuthError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errInsufficientScope) || errors.Is(err, errAccountSuspended) ||
+		errors.Is(err, errPasswordResetRequired) {
+		respondWithError(w, 403, err.Error())
+		return
+	}
+	respondWithError(w, 401, err.Error())
+}
+
+// hashToken digests a high-entropy secret for storage. It is not suitable
+// for user passwords.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func findAccessToken(db *DB, token string) (AccessToken, error) {
+	dbStructure, err := db.LoadDB()
+	if err != nil {
+		return AccessToken{}, err
+	}
+
+	tokenHash := hashToken(token)
+	for _, accessToken := range dbStructure.AccessTokens {
+		if accessToken.TokenHash != tokenHash {
+			continue
+		}
+		if accessToken.ExpiresAt != nil && time.Now().UTC().After(*accessToken.ExpiresAt) {
+			return AccessToken{}, errInvalidCredentials
+		}
+		return accessToken, nil
+	}
+
+	return AccessToken{}, errInvalidCredentials
+}
+
+// createAccessToken stores a new token and returns it along with the
+// plaintext value, which is never persisted.
+func createAccessToken(db *DB, userID int, name string, scopes []string, expiresInSeconds int) (AccessToken, string, error) {
+	plaintext := accessTokenPrefix + generateRefreshToken()
+	accessToken := AccessToken{
+		UserID:    userID,
+		Name:      name,
+		Scopes:    scopes,
+		TokenHash: hashToken(plaintext),
+		CreatedAt: time.Now().UTC(),
+	}
+	if expiresInSeconds > 0 {
+		expiresAt := accessToken.CreatedAt.Add(time.Duration(expiresInSeconds) * time.Second)
+		accessToken.ExpiresAt = &expiresAt
+	}
+
+	err := db.update(func(dbStructure *DBStructure) error {
+		accessToken.ID = 1
+		for id := range dbStructure.AccessTokens {
+			if id >= accessToken.ID {
+				accessToken.ID = id + 1
+			}
+		}
+		dbStructure.AccessTokens[accessToken.ID] = accessToken
+		return nil
+	})
+	if err != nil {
+		return AccessToken{}, "", err
+	}
+
+	return accessToken, plaintext, nil
+}
+
+func getAccessTokens(db *DB, userID int) ([]AccessToken, error) {
+	dbStructure, err := db.LoadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := []AccessToken{}
+	for _, accessToken := range dbStructure.AccessTokens {
+		if accessToken.UserID == userID {
+			tokens = append(tokens, accessToken)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].ID < tokens[j].ID })
+
+	return tokens, nil
+}
+
+func deleteAccessToken(db *DB, userID, tokenID int) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		accessToken, found := dbStructure.AccessTokens[tokenID]
+		if !found || accessToken.UserID != userID {
+			return errors.New("token not found")
+		}
+		delete(dbStructure.AccessTokens, tokenID)
+		return nil
+	})
+}
+
+type accessTokenResponse struct {
+	ID        int        `json:"id"`
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	Token     string     `json:"token,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func newAccessTokenResponse(accessToken AccessToken, plaintext string) accessTokenResponse {
+	return accessTokenResponse{
+		ID:        accessToken.ID,
+		Name:      accessToken.Name,
+		Scopes:    accessToken.Scopes,
+		Token:     plaintext,
+		CreatedAt: accessToken.CreatedAt,
+		ExpiresAt: accessToken.ExpiresAt,
+	}
+}
+
+/*
+route: /api/tokens
+method: POST
+
+	req body shape: {
+		name string
+		scopes []string
+		expires_in_seconds int (optional, never expires when omitted)
+	}
+
+	req headers: {
+		Authorization string (jwtToken)
+	}
+
+The plaintext token is only returned in this response. Scopes are
+chirps:read, chirps:write, users:write, messages:read, messages:write and
+admin; without admin the token can't use the user's role permissions.
+chirps:read doesn't gate reading public chirps, which needs no token at all;
+it covers the home timeline, bookmarks and notifications, and lets the token
+see followers-only chirps.
+*/
+func (config *apiConfig) createAccessTokenHandler(w http.ResponseWriter, req *http.Request) {
+	// tokens can only be minted from a real login session
+	id, err := config.authenticateSession(req)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	params, err := decodeJSON(req)
+	if err != nil {
+		respondWithError(w, 500, "error decoding request body")
+		return
+	}
+
+	if params.Name == "" {
+		respondWithError(w, 400, "token name is required")
+		return
+	}
+	if len(params.Scopes) == 0 {
+		respondWithError(w, 400, "at least one scope is required")
+		return
+	}
+	if params.ExpiresInSeconds < 0 {
+		respondWithError(w, 400, "expires_in_seconds can't be negative")
+		return
+	}
+	for _, scope := range params.Scopes {
+		if !slices.Contains(validScopes, scope) {
+			respondWithError(w, 400, "unknown scope: "+scope)
+			return
+		}
+	}
+
+	accessToken, plaintext, err := createAccessToken(config.db, id, params.Name, params.Scopes, params.ExpiresInSeconds)
+	if err != nil {
+		respondWithError(w, 500, err.Error())
+		return
+	}
+
+	respondWithJSON(w, 201, newAccessTokenResponse(accessToken, plaintext))
+}
+
+/*
+route: /api/tokens
+method: GET
+
+	req headers: {
+		Authorization string (jwtToken)
+	}
+*/
+func (config *apiConfig) getAccessTokensHandler(w http.ResponseWriter, req *http.Request) {
+	id, err := config.authenticateSession(req)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	tokens, err := getAccessTokens(config.db, id)
+	if err != nil {
+		respondWithError(w, 500, err.Error())
+		return
+	}
+
+	response := make([]accessTokenResponse, len(tokens))
+	for i, accessToken := range tokens {
+		response[i] = newAccessTokenResponse(accessToken, "")
+	}
+
+	respondWithJSON(w, 200, response)
+}
+
+/*
+route: /api/tokens/{tokenID}
+method: DELETE
+
+	req headers: {
+		Authorization string (jwtToken)
+	}
+*/
+func (config *apiConfig) deleteAccessTokenHandler(w http.ResponseWriter, req *http.Request) {
+	id, err := config.authenticateSession(req)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	tokenID, err := strconv.Atoi(req.PathValue("tokenID"))
+	if err != nil {
+		respondWithError(w, 400, "invalid token id")
+		return
+	}
+
+	err = deleteAccessToken(config.db, id, tokenID)
+	if err != nil {
+		if err.Error() == "token not found" {
+			respondWithError(w, 404, err.Error())
+			return
+		}
+		respondWithError(w, 500, err.Error())
+		return
+	}
+
+	w.WriteHeader(204)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"slices"
+)
+
+// who a chirp is for; set when it's posted
+const (
+	visibilityPublic = "public"
+	// only the author's followers, and users the chirp mentions
+	visibilityFollowers = "followers"
+	// readable by anyone with the link but left out of public listings
+	visibilityUnlisted = "unlisted"
+)
+
+var (
+	errInvalidVisibility = errors.New("visibility must be one of public, followers, unlisted")
+	errNotRechirpable    = errors.New("followers-only chirps can't be rechirped")
+)
+
+// chirpReadContext is where a chirp is being read, which decides whether
+// unlisted chirps and mutes apply.
+type chirpReadContext int
+
+const (
+	// the chirp asked for by id and chirps shown alongside it: threads,
+	// quoted originals, notifications
+	readDirect chirpReadContext = iota
+	// the viewer's home timeline
+	readHomeTimeline
+	// chirps listed by author, as on a profile
+	readAuthorListing
+	// everything else that lists chirps: GET /api/chirps, search, hashtags
+	readPublicListing
+)
+
+func parseVisibility(visibility string) (string, error) {
+	switch visibility {
+	case "":
+		return visibilityPublic, nil
+	case visibilityPublic, visibilityFollowers, visibilityUnlisted:
+		return visibility, nil
+	default:
+		return "", errInvalidVisibility
+	}
+}
+
+// chirpViewer is who chirps are read for: the user, ID 0 when anonymous, and
+// the scopes of the credential they sent, nil for session JWTs. Scopes only
+// matter for hidden chirps, so code that never shows those can leave them nil.
+type chirpViewer struct {
+	ID     int
+	Scopes []string
+}
+
+func canModerateChirps(dbStructure DBStructure, viewer chirpViewer) bool {
+	user, found := dbStructure.Users[viewer.ID]
+	return found && rolesApply(viewer.Scopes) && hasPermission(user, permHideChirps)
+}
+
+/*
+canViewChirp is the one place that decides whether viewer may see a chirp. Every handler that reads chirps filters them through it, so a
+chirp is never reachable somewhere it shouldn't be. It covers deletion,
+moderation, blocks and mutes, and the chirp's visibility. A rechirp reaches
+whoever its original does.
+*/
+func canViewChirp(dbStructure DBStructure, viewer chirpViewer, chirp Chirp, context chirpReadContext) bool {
+	viewerID := viewer.ID
+	if chirp.Deleted {
+		return false
+	}
+	if chirp.Hidden && (viewerID == 0 || viewerID != chirp.AuthorID) && !canModerateChirps(dbStructure, viewer) {
+		return false
+	}
+	includeMuted := context == readHomeTimeline || context == readPublicListing
+	if dbStructure.hiddenFrom(viewerID, chirp, includeMuted) {
+		return false
+	}
+
+	if chirp.RechirpOf != 0 {
+		// a rechirp of a deleted or hidden original still shows, with the
+		// original marked unavailable
+		chirp = dbStructure.Chirps[chirp.RechirpOf]
+	}
+	if viewerID != 0 && viewerID == chirp.AuthorID {
+		return true
+	}
+	switch chirp.Visibility {
+	case visibilityFollowers:
+		return viewerID != 0 && (dbStructure.isFollowing(viewerID, chirp.AuthorID) ||
+			slices.Contains(mentionedUsers(chirp.Mentions), viewerID))
+	case visibilityUnlisted:
+		return context != readPublicListing
+	default:
+		return true
+	}
+}
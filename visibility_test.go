@@ -0,0 +1,112 @@
+package main
+
+import "testing"
+
+func TestCanViewChirp(t *testing.T) {
+	const (
+		author = iota + 1
+		follower
+		stranger
+		blocked
+		moderator
+		muter
+		mentioned
+	)
+	dbStructure := DBStructure{
+		Users: map[int]User{
+			author:    {ID: author},
+			follower:  {ID: follower},
+			stranger:  {ID: stranger},
+			blocked:   {ID: blocked},
+			moderator: {ID: moderator, Role: roleModerator},
+			muter:     {ID: muter},
+			mentioned: {ID: mentioned},
+		},
+		Chirps: map[int]Chirp{
+			1: {ID: 1, AuthorID: author, Visibility: visibilityPublic},
+			2: {ID: 2, AuthorID: author, Visibility: visibilityFollowers, Mentions: []Mention{{UserID: mentioned}}},
+			3: {ID: 3, AuthorID: author, Visibility: visibilityUnlisted},
+			4: {ID: 4, AuthorID: author, Visibility: visibilityPublic, Hidden: true},
+			5: {ID: 5, AuthorID: author, Visibility: visibilityPublic, Deleted: true},
+			6: {ID: 6, AuthorID: stranger, Visibility: visibilityPublic, RechirpOf: 2},
+		},
+		Following: map[int][]Follow{follower: {{UserID: author}}},
+		Followers: map[int][]Follow{author: {{UserID: follower}}},
+		Blocks:    map[int][]Restriction{author: {{UserID: blocked}}},
+		Mutes:     map[int][]Restriction{muter: {{UserID: author}}},
+	}
+
+	tests := []struct {
+		name    string
+		viewer  int
+		chirpID int
+		context chirpReadContext
+		want    bool
+	}{
+		{"public to anonymous", 0, 1, readPublicListing, true},
+		{"public to blocked user", blocked, 1, readDirect, false},
+		{"public to muter directly", muter, 1, readDirect, true},
+		{"public to muter on profile", muter, 1, readAuthorListing, true},
+		{"public to muter in listing", muter, 1, readPublicListing, false},
+		{"public to muter on home timeline", muter, 1, readHomeTimeline, false},
+		{"followers-only to anonymous", 0, 2, readDirect, false},
+		{"followers-only to stranger", stranger, 2, readDirect, false},
+		{"followers-only to follower", follower, 2, readPublicListing, true},
+		{"followers-only to mentioned user", mentioned, 2, readDirect, true},
+		{"followers-only to author", author, 2, readDirect, true},
+		{"unlisted directly", 0, 3, readDirect, true},
+		{"unlisted on profile", stranger, 3, readAuthorListing, true},
+		{"unlisted in listing", stranger, 3, readPublicListing, false},
+		{"unlisted in listing to author", author, 3, readPublicListing, true},
+		{"hidden to anonymous", 0, 4, readDirect, false},
+		{"hidden to stranger", stranger, 4, readDirect, false},
+		{"hidden to author", author, 4, readDirect, true},
+		{"hidden to moderator", moderator, 4, readDirect, true},
+		{"deleted to author", author, 5, readDirect, false},
+		{"deleted to moderator", moderator, 5, readDirect, false},
+		{"rechirp of followers-only to rechirper", stranger, 6, readDirect, false},
+		{"rechirp of followers-only to follower", follower, 6, readDirect, true},
+		{"rechirp of followers-only to anonymous", 0, 6, readDirect, false},
+		{"rechirp to user blocked by original author", blocked, 6, readDirect, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := canViewChirp(dbStructure, chirpViewer{ID: tt.viewer}, dbStructure.Chirps[tt.chirpID], tt.context)
+			if got != tt.want {
+				t.Errorf("canViewChirp(viewer %d, chirp %d) = %v, want %v", tt.viewer, tt.chirpID, got, tt.want)
+			}
+		})
+	}
+}
+
+// A moderator's delegated token only sees hidden chirps with the admin scope.
+func TestCanViewChirpDelegatedModerator(t *testing.T) {
+	dbStructure := DBStructure{
+		Users: map[int]User{
+			1: {ID: 1},
+			2: {ID: 2, Role: roleModerator},
+		},
+		Chirps: map[int]Chirp{
+			1: {ID: 1, AuthorID: 1, Visibility: visibilityPublic, Hidden: true},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		scopes []string
+		want   bool
+	}{
+		{"session", nil, true},
+		{"token without admin", []string{scopeChirpsRead}, false},
+		{"token with admin", []string{scopeChirpsRead, scopeAdmin}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			viewer := chirpViewer{ID: 2, Scopes: tt.scopes}
+			got := canViewChirp(dbStructure, viewer, dbStructure.Chirps[1], readDirect)
+			if got != tt.want {
+				t.Errorf("canViewChirp(scopes %v) = %v, want %v", tt.scopes, got, tt.want)
+			}
+		})
+	}
+}